@@ -0,0 +1,355 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/go-kit/log/level"
+	"github.com/prometheus/common/route"
+	"golang.org/x/exp/slices"
+	"gopkg.in/yaml.v3"
+)
+
+// apiV1Prefix is the path of the versioned API.
+const apiV1Prefix = "/api/v1"
+
+var (
+	errGroupNotFound = errors.New("group not found")
+	errRuleNotFound  = errors.New("rule not found")
+)
+
+// versioned registers f under apiV1Prefix and, as a deprecated alias, under
+// the unversioned /api path it was served on first.
+func versioned(register func(string, http.HandlerFunc), path string, f http.HandlerFunc) {
+	register(apiV1Prefix+path, f)
+	register("/api"+path, deprecated(apiV1Prefix+path, f))
+}
+
+// deprecated marks the responses of f as deprecated in favor of successor.
+func deprecated(successor string, f http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Deprecation", "true")
+		w.Header().Set("Link", fmt.Sprintf("<%s>; rel=\"successor-version\"", successor))
+		f(w, r)
+	}
+}
+
+// decodeJSON decodes the request body into v. Unknown fields are rejected,
+// like Parse does for rule files.
+func decodeJSON(r *http.Request, v interface{}) error {
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	return decoder.Decode(v)
+}
+
+// decodeRules decodes the request body into v and answers with a bad request
+// if it cannot be decoded.
+func (h *Handler) decodeRules(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	if err := decodeJSON(r, v); err != nil {
+		level.Error(h.logger).Log("msg", fmt.Sprintf("Error decoding request body: %s", err))
+		validationFailures.WithLabelValues(validationDecode).Inc()
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "Group rules cannot be decoded: %s\n", err)
+		return false
+	}
+	return true
+}
+
+// validateGroup returns the errors Parse finds in group.
+func validateGroup(group SimpleRuleGroup) ([]string, error) {
+	b, err := yaml.Marshal(&RuleGroups{Groups: []RuleGroup{newRuleGroupNode(group)}})
+	if err != nil {
+		return nil, err
+	}
+	var problems []string
+	_, errs := Parse(b)
+	for _, err := range errs {
+		problems = append(problems, strings.TrimSpace(err.Error()))
+	}
+	return problems, nil
+}
+
+// checkGroup answers with a bad request if group is invalid.
+func (h *Handler) checkGroup(w http.ResponseWriter, group SimpleRuleGroup) bool {
+	problems, err := validateGroup(group)
+	if err != nil {
+		h.writeError(w, "Rules cannot be validated", err)
+		return false
+	}
+	if len(problems) > 0 {
+		validationFailures.WithLabelValues(validationParse).Inc()
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "Group has errors:\n")
+		for _, p := range problems {
+			fmt.Fprintf(w, "%s\n", p)
+		}
+		return false
+	}
+	return true
+}
+
+// registerAPI registers the resource routes of the v1 API.
+func (h *Handler) registerAPI(router *route.Router) {
+	router.Get(apiV1Prefix+"/openapi.json", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, openAPI())
+	})
+	router.Get(apiV1Prefix+"/groups", h.listGroups)
+	router.Get(apiV1Prefix+"/groups/:group", h.getGroup)
+	router.Put(apiV1Prefix+"/groups/:group", h.leaderOnly(h.idempotent(h.putGroup)))
+	router.Del(apiV1Prefix+"/groups/:group", h.leaderOnly(h.idempotent(h.deleteGroup)))
+	router.Get(apiV1Prefix+"/groups/:group/submitted-exprs", h.submittedGroupExprs)
+	router.Post(apiV1Prefix+"/groups/:group/rules", h.leaderOnly(h.idempotent(h.addGroupRules)))
+	router.Del(apiV1Prefix+"/groups/:group/rules/:rule", h.leaderOnly(h.idempotent(h.deleteGroupRule)))
+	router.Get(apiV1Prefix+"/conflicts", h.conflicts)
+	router.Get(apiV1Prefix+"/templates", h.listTemplates)
+	router.Get(apiV1Prefix+"/templates/:name", h.getTemplate)
+	router.Put(apiV1Prefix+"/templates/:name", h.leaderOnly(h.idempotent(h.putTemplate)))
+	router.Del(apiV1Prefix+"/templates/:name", h.leaderOnly(h.idempotent(h.deleteTemplate)))
+	router.Get(apiV1Prefix+"/templates/:name/instances", h.listTemplateInstances)
+	router.Post(apiV1Prefix+"/templates/:name/instantiate", h.leaderOnly(h.idempotent(h.instantiateTemplate)))
+	router.Get(apiV1Prefix+"/slos", h.listSLOs)
+	router.Get(apiV1Prefix+"/slos/:name", h.getSLO)
+	router.Put(apiV1Prefix+"/slos/:name", h.leaderOnly(h.idempotent(h.putSLO)))
+	router.Del(apiV1Prefix+"/slos/:name", h.leaderOnly(h.idempotent(h.deleteSLO)))
+	router.Post(apiV1Prefix+"/history/:revision/rollback", h.leaderOnly(h.idempotent(h.rollback)))
+}
+
+func (h *Handler) listGroups(w http.ResponseWriter, r *http.Request) {
+	rulesManager, err := NewCachedRulesManager()
+	if err != nil {
+		h.writeError(w, "Rules cannot be read", err)
+		return
+	}
+	groups := make([]SimpleRuleGroup, 0, len(rulesManager.ruleGroups.Groups))
+	for _, g := range rulesManager.ruleGroups.Groups {
+		groups = append(groups, newSimpleRuleGroup(g))
+	}
+	writeJSON(w, http.StatusOK, groups)
+}
+
+func (h *Handler) getGroup(w http.ResponseWriter, r *http.Request) {
+	name := route.Param(r.Context(), "group")
+	rulesManager, err := NewCachedRulesManager()
+	if err != nil {
+		h.writeError(w, "Rules cannot be read", err)
+		return
+	}
+	for _, g := range rulesManager.ruleGroups.Groups {
+		if g.Name == name {
+			writeJSON(w, http.StatusOK, newSimpleRuleGroup(g))
+			return
+		}
+	}
+	w.WriteHeader(http.StatusNotFound)
+	fmt.Fprintf(w, "Group %q does not exist.\n", name)
+}
+
+func (h *Handler) putGroup(w http.ResponseWriter, r *http.Request) {
+	name := route.Param(r.Context(), "group")
+	var group SimpleRuleGroup
+	if !h.decodeRules(w, r, &group) {
+		return
+	}
+	if group.Name == "" {
+		group.Name = name
+	}
+	if group.Name != name {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "Group name %q does not match the path.\n", group.Name)
+		return
+	}
+	if !h.checkGroup(w, group) {
+		return
+	}
+
+	op := putGroupOp(group)
+	if r.URL.Query().Get("dryRun") == "true" {
+		h.dryRun(w, op)
+		return
+	}
+	if err := h.write(w, r, op); err != nil {
+		h.writeError(w, "Group cannot be written", err)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, "Group is written successfully.\n")
+}
+
+func (h *Handler) deleteGroup(w http.ResponseWriter, r *http.Request) {
+	op := deleteGroupOp(route.Param(r.Context(), "group"))
+	if r.URL.Query().Get("dryRun") == "true" {
+		h.dryRun(w, op)
+		return
+	}
+	if err := h.write(w, r, op); err != nil {
+		h.writeError(w, "Group cannot be deleted", err)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, "Group is deleted successfully.\n")
+}
+
+func (h *Handler) addGroupRules(w http.ResponseWriter, r *http.Request) {
+	group := SimpleRuleGroup{Name: route.Param(r.Context(), "group")}
+	if !h.decodeRules(w, r, &group.Rules) {
+		return
+	}
+	if !h.checkGroup(w, group) {
+		return
+	}
+	h.addRules(w, r, group)
+}
+
+func (h *Handler) deleteGroupRule(w http.ResponseWriter, r *http.Request) {
+	op := deleteRuleOp(route.Param(r.Context(), "group"), route.Param(r.Context(), "rule"), r.URL.Query().Get("expr"))
+	if r.URL.Query().Get("dryRun") == "true" {
+		h.dryRun(w, op)
+		return
+	}
+	if err := h.write(w, r, op); err != nil {
+		h.writeError(w, "Rules cannot be deleted", err)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, "Rules are deleted successfully.\n")
+}
+
+// rollback restores the rule groups as they were after the given revision.
+func (h *Handler) rollback(w http.ResponseWriter, r *http.Request) {
+	revision := route.Param(r.Context(), "revision")
+	groups, ok := h.options.Watcher.snapshot(revision)
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(w, "Revision %q is unknown or too old to roll back to.\n", revision)
+		return
+	}
+
+	op := rollbackOp(revision, groups)
+	if r.URL.Query().Get("dryRun") == "true" {
+		h.dryRun(w, op)
+		return
+	}
+	if err := h.write(w, r, op); err != nil {
+		h.writeError(w, "Rules cannot be rolled back", err)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, "Rules are rolled back to revision %s successfully.\n", revision)
+}
+
+// addRules adds the rules of ruleGroup, after checking them against the live
+// Prometheus if configured.
+func (h *Handler) addRules(w http.ResponseWriter, r *http.Request, ruleGroup SimpleRuleGroup) {
+	if r.URL.Query().Get("dryRun") == "true" {
+		h.dryRun(w, addRulesOp(ruleGroup))
+		return
+	}
+	var warnings []string
+	if h.options.ExprChecker != nil {
+		rulesManager, err := NewCachedRulesManager()
+		if err != nil {
+			h.writeError(w, "Rules cannot be read", err)
+			return
+		}
+		warnings = h.options.ExprChecker.CheckGroup(r.Context(), rulesManager.ruleGroups, ruleGroup)
+		validationFailures.WithLabelValues(validationLiveCheck).Add(float64(len(warnings)))
+	}
+	if err := h.write(w, r, addRulesOp(ruleGroup)); err != nil {
+		h.writeError(w, "Rules cannot be added", err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, "Rules are added successfully.\n")
+	for _, warning := range warnings {
+		level.Warn(h.logger).Log("msg", "Live expression check", "group", ruleGroup.Name, "warning", warning)
+		fmt.Fprintf(w, "Warning: %s\n", warning)
+	}
+}
+
+// putGroupOp creates the group or replaces the group of the same name.
+func putGroupOp(group SimpleRuleGroup) writeOp {
+	return writeOp{
+		description: fmt.Sprintf("Replace group %q", group.Name),
+		mutate: func(manager *RulesManager) error {
+			manager.importGroups([]RuleGroup{newRuleGroupNode(manager.canonicalizeGroup(group))}, importReplaceGroups)
+			return nil
+		},
+	}
+}
+
+// rollbackOp replaces all rule groups with groups, as they were after the
+// given revision. SLOs are not part of the history, the groups generated from
+// the current SLOs are kept as they are.
+func rollbackOp(revision string, groups []SimpleRuleGroup) writeOp {
+	return writeOp{
+		description: fmt.Sprintf("Roll back to revision %s", revision),
+		mutate: func(manager *RulesManager) error {
+			generated := map[string]struct{}{}
+			for _, slo := range manager.slos() {
+				generated[slo.groupName()] = struct{}{}
+			}
+			nodes := make([]RuleGroup, 0, len(groups))
+			for _, g := range groups {
+				if _, ok := generated[g.Name]; !ok {
+					nodes = append(nodes, newRuleGroupNode(g))
+				}
+			}
+			for _, g := range manager.ruleGroups.Groups {
+				if _, ok := generated[g.Name]; ok {
+					nodes = append(nodes, g)
+				}
+			}
+			manager.importGroups(nodes, importReplaceAll)
+			return nil
+		},
+	}
+}
+
+// deleteGroupOp deletes the group with the given name.
+func deleteGroupOp(name string) writeOp {
+	return writeOp{
+		description: fmt.Sprintf("Delete group %q", name),
+		mutate: func(manager *RulesManager) error {
+			for i, g := range manager.ruleGroups.Groups {
+				if g.Name == name {
+					manager.ruleGroups.Groups = slices.Delete(manager.ruleGroups.Groups, i, i+1)
+					return nil
+				}
+			}
+			return fmt.Errorf("%w: %q", errGroupNotFound, name)
+		},
+	}
+}
+
+// deleteRuleOp deletes the alerting and recording rules named name from the
+// group, only those with the given expression if expr is not empty.
+func deleteRuleOp(group, name, expr string) writeOp {
+	return writeOp{
+		description: fmt.Sprintf("Delete rule %q from group %q", name, group),
+		mutate: func(manager *RulesManager) error {
+			for i, g := range manager.ruleGroups.Groups {
+				if g.Name != group {
+					continue
+				}
+				rules := make([]RuleNode, 0, len(g.Rules))
+				for _, rule := range g.Rules {
+					named := rule.Alert.Value == name || rule.Record.Value == name
+					if named && (expr == "" || sameExpr(rule.Expr.Value, expr)) {
+						continue
+					}
+					rules = append(rules, rule)
+				}
+				if len(rules) == len(g.Rules) {
+					return fmt.Errorf("%w: %q", errRuleNotFound, name)
+				}
+				manager.ruleGroups.Groups[i].Rules = rules
+				return nil
+			}
+			return fmt.Errorf("%w: %q", errGroupNotFound, group)
+		},
+	}
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/go-kit/log/level"
+	"gopkg.in/yaml.v3"
+)
+
+// ownersAnnotation stores which source applied each group, as a JSON object
+// mapping group names to source names.
+const ownersAnnotation = annotationPrefix + "owners"
+
+// errOwnership is returned when applying would modify groups owned by
+// another source or made by hand.
+var errOwnership = errors.New("groups are not owned by the source")
+
+// ApplyPlan lists the group changes needed to converge to a desired state.
+type ApplyPlan struct {
+	Source    string   `json:"source"`
+	Add       []string `json:"add"`
+	Update    []string `json:"update"`
+	Delete    []string `json:"delete"`
+	Unchanged []string `json:"unchanged"`
+	Applied   bool     `json:"applied"`
+}
+
+// owners returns the source owning each applied group.
+func (manager *RulesManager) owners() map[string]string {
+	owners := map[string]string{}
+	if v, ok := manager.annotations[ownersAnnotation]; ok {
+		// A corrupted annotation leaves all groups unowned.
+		json.Unmarshal([]byte(v), &owners)
+	}
+	return owners
+}
+
+// setOwners stores the source owning each applied group. Groups which no
+// longer exist are dropped.
+func (manager *RulesManager) setOwners(owners map[string]string) {
+	existing := map[string]struct{}{}
+	for _, g := range manager.ruleGroups.Groups {
+		existing[g.Name] = struct{}{}
+	}
+	for group := range owners {
+		if _, ok := existing[group]; !ok {
+			delete(owners, group)
+		}
+	}
+	if len(owners) == 0 {
+		delete(manager.annotations, ownersAnnotation)
+		return
+	}
+	b, _ := json.Marshal(owners)
+	manager.annotations[ownersAnnotation] = string(b)
+}
+
+// plan computes the changes converging the groups applied by source to
+// desired. Groups of other sources and hand-made groups are left alone, it is
+// an error for desired to contain them unless force is set.
+func (manager *RulesManager) plan(source string, desired []RuleGroup, force bool) (*ApplyPlan, error) {
+	plan := &ApplyPlan{
+		Source:    source,
+		Add:       []string{},
+		Update:    []string{},
+		Delete:    []string{},
+		Unchanged: []string{},
+	}
+	owners := manager.owners()
+	current := map[string]RuleGroup{}
+	for _, g := range manager.ruleGroups.Groups {
+		current[g.Name] = g
+	}
+
+	var notOwned []string
+	wanted := map[string]struct{}{}
+	for _, g := range desired {
+		wanted[g.Name] = struct{}{}
+		existing, ok := current[g.Name]
+		if !ok {
+			plan.Add = append(plan.Add, g.Name)
+			continue
+		}
+		if owners[g.Name] != source && !force {
+			notOwned = append(notOwned, g.Name)
+			continue
+		}
+		if groupsEqual(existing, g) && owners[g.Name] == source {
+			plan.Unchanged = append(plan.Unchanged, g.Name)
+		} else {
+			plan.Update = append(plan.Update, g.Name)
+		}
+	}
+	for group, owner := range owners {
+		if _, ok := current[group]; !ok {
+			// Removed by another write, a group of the same name made
+			// later is not the source's.
+			continue
+		}
+		if _, ok := wanted[group]; !ok && owner == source {
+			plan.Delete = append(plan.Delete, group)
+		}
+	}
+	sort.Strings(plan.Delete)
+
+	if len(notOwned) > 0 {
+		return plan, fmt.Errorf("%w %q: %s", errOwnership, source, strings.Join(notOwned, ", "))
+	}
+	return plan, nil
+}
+
+// applyOp converges the groups applied by source to desired and stores the
+// plan it carried out in plan.
+func applyOp(source string, desired []RuleGroup, force bool, plan *ApplyPlan) writeOp {
+	return writeOp{
+		description: fmt.Sprintf("Apply %d groups from source %q", len(desired), source),
+		mutate: func(manager *RulesManager) error {
+			desired := manager.canonicalizeGroups(desired)
+			p, err := manager.plan(source, desired, force)
+			*plan = *p
+			if err != nil {
+				return err
+			}
+			manager.applyPlan(p, desired)
+			return nil
+		},
+	}
+}
+
+func (manager *RulesManager) applyPlan(plan *ApplyPlan, desired []RuleGroup) {
+	desiredGroups := map[string]RuleGroup{}
+	for _, g := range desired {
+		desiredGroups[g.Name] = g
+	}
+	deleted := map[string]struct{}{}
+	for _, group := range plan.Delete {
+		deleted[group] = struct{}{}
+	}
+
+	groups := make([]RuleGroup, 0, len(manager.ruleGroups.Groups)+len(plan.Add))
+	for _, g := range manager.ruleGroups.Groups {
+		if _, ok := deleted[g.Name]; ok {
+			continue
+		}
+		if d, ok := desiredGroups[g.Name]; ok {
+			g = d
+		}
+		groups = append(groups, g)
+	}
+	for _, group := range plan.Add {
+		groups = append(groups, desiredGroups[group])
+	}
+	manager.ruleGroups.Groups = groups
+
+	owners := manager.owners()
+	for _, group := range plan.Delete {
+		delete(owners, group)
+	}
+	for group := range desiredGroups {
+		owners[group] = plan.Source
+	}
+	manager.setOwners(owners)
+}
+
+// groupsEqual reports whether both groups serialize to the same rule file.
+func groupsEqual(a, b RuleGroup) bool {
+	ab, err := yaml.Marshal(&a)
+	if err != nil {
+		return false
+	}
+	bb, err := yaml.Marshal(&b)
+	if err != nil {
+		return false
+	}
+	return string(ab) == string(bb)
+}
+
+func (h *Handler) applyRules(w http.ResponseWriter, r *http.Request) {
+	level.Info(h.logger).Log("msg", "Apply rules...")
+	source := r.URL.Query().Get("source")
+	if source == "" || invalidFileNameChars.MatchString(source) {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "Invalid source %q.\n", source)
+		return
+	}
+	force := r.URL.Query().Get("force") == "true"
+	dryRun := r.URL.Query().Get("dryRun") == "true"
+
+	b, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxImportSize))
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+		fmt.Fprintf(w, "Rule file exceeds the limit of %d bytes.\n", maxImportSize)
+		return
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "Request body cannot be read.\n")
+		return
+	}
+	desired, errs := Parse(b)
+	if len(errs) > 0 {
+		validationFailures.WithLabelValues(validationParse).Inc()
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "Rule file has errors:\n")
+		for _, err := range errs {
+			fmt.Fprintf(w, "%s\n", strings.TrimSpace(err.Error()))
+		}
+		return
+	}
+
+	plan := &ApplyPlan{Source: source}
+	if dryRun {
+		rulesManager, err := NewRulesManager()
+		if err != nil {
+			h.writeError(w, "Rules cannot be read", err)
+			return
+		}
+		plan, err = rulesManager.plan(source, rulesManager.canonicalizeGroups(desired.Groups), force)
+	} else {
+		err = h.write(w, r, applyOp(source, desired.Groups, force, plan))
+		plan.Applied = err == nil
+	}
+	if errors.Is(err, errOwnership) {
+		w.WriteHeader(http.StatusConflict)
+		fmt.Fprintf(w, "Rules cannot be applied: %s\n", err)
+		return
+	}
+	if err != nil {
+		h.writeError(w, "Rules cannot be applied", err)
+		return
+	}
+	writeJSON(w, http.StatusOK, plan)
+}
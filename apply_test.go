@@ -0,0 +1,102 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+// newTestManager returns a manager holding groups, without a ConfigMap.
+func newTestManager(groups ...SimpleRuleGroup) *RulesManager {
+	manager := &RulesManager{
+		ruleGroups:  &RuleGroups{Groups: []RuleGroup{}},
+		annotations: map[string]string{},
+	}
+	for _, g := range groups {
+		manager.ruleGroups.Groups = append(manager.ruleGroups.Groups, newRuleGroupNode(g))
+	}
+	return manager
+}
+
+func TestPlan(t *testing.T) {
+	group := func(name, expr string) SimpleRuleGroup {
+		return SimpleRuleGroup{Name: name, Rules: []Rule{{Record: name + ":rule", Expr: expr}}}
+	}
+
+	for _, tc := range []struct {
+		name    string
+		current []SimpleRuleGroup
+		owners  map[string]string
+		desired []SimpleRuleGroup
+		force   bool
+		want    ApplyPlan
+		err     error
+	}{
+		{
+			name:    "new groups are added",
+			desired: []SimpleRuleGroup{group("a", "up")},
+			want:    ApplyPlan{Add: []string{"a"}},
+		},
+		{
+			name:    "owned groups are updated or left unchanged",
+			current: []SimpleRuleGroup{group("a", "up"), group("b", "up")},
+			owners:  map[string]string{"a": "git", "b": "git"},
+			desired: []SimpleRuleGroup{group("a", "up"), group("b", "1 - up")},
+			want:    ApplyPlan{Update: []string{"b"}, Unchanged: []string{"a"}},
+		},
+		{
+			name:    "owned groups no longer desired are deleted",
+			current: []SimpleRuleGroup{group("a", "up"), group("b", "up"), group("c", "up")},
+			owners:  map[string]string{"a": "git", "b": "git", "c": "other"},
+			desired: []SimpleRuleGroup{group("a", "up")},
+			want:    ApplyPlan{Delete: []string{"b"}, Unchanged: []string{"a"}},
+		},
+		{
+			name:    "owners of removed groups are skipped",
+			current: []SimpleRuleGroup{group("a", "up")},
+			owners:  map[string]string{"a": "git", "gone": "git"},
+			desired: []SimpleRuleGroup{group("a", "up")},
+			want:    ApplyPlan{Unchanged: []string{"a"}},
+		},
+		{
+			name:    "groups of other sources are refused",
+			current: []SimpleRuleGroup{group("a", "up"), group("b", "up")},
+			owners:  map[string]string{"a": "other"},
+			desired: []SimpleRuleGroup{group("a", "up"), group("b", "up")},
+			err:     errOwnership,
+		},
+		{
+			name:    "groups of other sources are taken over with force",
+			current: []SimpleRuleGroup{group("a", "up"), group("b", "up")},
+			owners:  map[string]string{"a": "other"},
+			desired: []SimpleRuleGroup{group("a", "up"), group("b", "up")},
+			force:   true,
+			want:    ApplyPlan{Update: []string{"a", "b"}},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			manager := newTestManager(tc.current...)
+			manager.setOwners(tc.owners)
+			desired := make([]RuleGroup, 0, len(tc.desired))
+			for _, g := range tc.desired {
+				desired = append(desired, newRuleGroupNode(g))
+			}
+
+			plan, err := manager.plan("git", desired, tc.force)
+			if !errors.Is(err, tc.err) {
+				t.Fatalf("err = %v, want %v", err, tc.err)
+			}
+			if tc.err != nil {
+				return
+			}
+			want := ApplyPlan{Source: "git", Add: []string{}, Update: []string{}, Delete: []string{}, Unchanged: []string{}}
+			want.Add = append(want.Add, tc.want.Add...)
+			want.Update = append(want.Update, tc.want.Update...)
+			want.Delete = append(want.Delete, tc.want.Delete...)
+			want.Unchanged = append(want.Unchanged, tc.want.Unchanged...)
+			if !reflect.DeepEqual(*plan, want) {
+				t.Errorf("plan = %+v, want %+v", *plan, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/alecthomas/kingpin"
+)
+
+var trustedProxyCIDRs = kingpin.Flag("web.trusted-proxy", "CIDR of the authenticating proxies whose X-Forwarded-User and X-Remote-User headers name the user making a request. Replicas proxying writes to the leader must be included for the headers to reach it. May be repeated.").Strings()
+
+// trustedProxies holds the parsed trustedProxyCIDRs.
+var trustedProxies []*net.IPNet
+
+// Change describes a committed write of the rule groups.
+type Change struct {
+	Time        time.Time
+	Actor       string
+	Description string
+	Before      []SimpleRuleGroup
+	After       []SimpleRuleGroup
+	// Originals holds the submitted expressions of the rules whose
+	// expressions were formatted, by originalKey.
+	Originals map[string]string
+}
+
+var (
+	changeListenersMtx sync.RWMutex
+	changeListeners    []func(Change)
+)
+
+// onChange registers f to be called after every committed change. f is called
+// synchronously from the write path and must not block.
+func onChange(f func(Change)) {
+	changeListenersMtx.Lock()
+	defer changeListenersMtx.Unlock()
+	changeListeners = append(changeListeners, f)
+}
+
+// notifyChange calls the registered listeners unless c changed nothing.
+func notifyChange(c Change) {
+	if reflect.DeepEqual(c.Before, c.After) {
+		return
+	}
+	changeListenersMtx.RLock()
+	defer changeListenersMtx.RUnlock()
+	for _, f := range changeListeners {
+		f(c)
+	}
+}
+
+// snapshot returns a copy of the rule groups which is not affected by later
+// changes of groups.
+func snapshot(groups *RuleGroups) []SimpleRuleGroup {
+	simple := make([]SimpleRuleGroup, 0, len(groups.Groups))
+	for _, g := range groups.Groups {
+		simple = append(simple, newSimpleRuleGroup(g))
+	}
+	return simple
+}
+
+// diffGroups returns the names of the groups added, updated and removed
+// between before and after.
+func diffGroups(before, after []SimpleRuleGroup) (added, updated, removed []string) {
+	old := make(map[string]SimpleRuleGroup, len(before))
+	for _, g := range before {
+		old[g.Name] = g
+	}
+	seen := make(map[string]struct{}, len(after))
+	for _, g := range after {
+		seen[g.Name] = struct{}{}
+		o, ok := old[g.Name]
+		switch {
+		case !ok:
+			added = append(added, g.Name)
+		case !reflect.DeepEqual(o, g):
+			updated = append(updated, g.Name)
+		}
+	}
+	for _, g := range before {
+		if _, ok := seen[g.Name]; !ok {
+			removed = append(removed, g.Name)
+		}
+	}
+	return added, updated, removed
+}
+
+// parseTrustedProxies parses the CIDRs of the trusted proxies.
+func parseTrustedProxies() error {
+	trustedProxies = nil
+	for _, cidr := range *trustedProxyCIDRs {
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return fmt.Errorf("invalid trusted proxy: %w", err)
+		}
+		trustedProxies = append(trustedProxies, ipNet)
+	}
+	return nil
+}
+
+// isTrustedProxy reports whether host is the address of a trusted proxy.
+func isTrustedProxy(host string) bool {
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	for _, ipNet := range trustedProxies {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// requestActor returns who made the request: the basic auth user, the user
+// set by a trusted authenticating proxy, or else the client host. The port is
+// left out, every connection of a client has another one.
+func requestActor(r *http.Request) string {
+	if user, _, ok := r.BasicAuth(); ok && user != "" {
+		return user
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	if isTrustedProxy(host) {
+		for _, header := range []string{"X-Forwarded-User", "X-Remote-User"} {
+			if user := r.Header.Get(header); user != "" {
+				return user
+			}
+		}
+	}
+	return host
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRequestActor(t *testing.T) {
+	defer func(cidrs []string) {
+		*trustedProxyCIDRs = cidrs
+		parseTrustedProxies()
+	}(*trustedProxyCIDRs)
+	*trustedProxyCIDRs = []string{"10.0.0.0/8"}
+	if err := parseTrustedProxies(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name       string
+		remoteAddr string
+		basicAuth  string
+		headers    map[string]string
+		want       string
+	}{
+		{
+			name:       "client host",
+			remoteAddr: "192.0.2.1:1234",
+			want:       "192.0.2.1",
+		},
+		{
+			name:       "basic auth user",
+			remoteAddr: "192.0.2.1:1234",
+			basicAuth:  "alice",
+			headers:    map[string]string{"X-Forwarded-User": "bob"},
+			want:       "alice",
+		},
+		{
+			name:       "user set by a trusted proxy",
+			remoteAddr: "10.1.2.3:1234",
+			headers:    map[string]string{"X-Remote-User": "bob"},
+			want:       "bob",
+		},
+		{
+			name:       "user set by an untrusted client",
+			remoteAddr: "192.0.2.1:1234",
+			headers:    map[string]string{"X-Forwarded-User": "bob", "X-Remote-User": "bob"},
+			want:       "192.0.2.1",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			r := httptest.NewRequest("POST", "/api/v1/rules", nil)
+			r.RemoteAddr = tc.remoteAddr
+			if tc.basicAuth != "" {
+				r.SetBasicAuth(tc.basicAuth, "secret")
+			}
+			for k, v := range tc.headers {
+				r.Header.Set(k, v)
+			}
+			if got := requestActor(r); got != tc.want {
+				t.Errorf("actor = %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,411 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/alecthomas/kingpin"
+	"github.com/pmezard/go-difflib/difflib"
+	"github.com/prometheus/prometheus/promql/parser"
+	"golang.org/x/exp/slices"
+	"gopkg.in/yaml.v3"
+)
+
+// Output formats of the check command.
+const (
+	checkText   = "text"
+	checkGitHub = "github"
+	checkGitLab = "gitlab"
+)
+
+var (
+	checkCmd       = kingpin.Command("check", "Check rule files offline: syntax, lint and dependencies between the rules. Exits with 1 if there are errors.")
+	checkFiles     = checkCmd.Arg("file", "Rule files to check.").Required().ExistingFiles()
+	checkFormat    = checkCmd.Flag("format", "Output format: text, GitHub Actions workflow commands or a GitLab code quality report.").Default(checkText).Enum(checkText, checkGitHub, checkGitLab)
+	checkLintFatal = checkCmd.Flag("lint-fatal", "Fail on lint and dependency warnings too.").Bool()
+
+	fmtCmd   = kingpin.Command("fmt", "Format rule files: indentation, key order and PromQL expressions.")
+	fmtFiles = fmtCmd.Arg("file", "Rule files to format in place.").Required().ExistingFiles()
+	fmtDiff  = fmtCmd.Flag("diff", "Print the changes instead of writing them. Exits with 3 if there are changes.").Bool()
+)
+
+// problemPosition matches the line and column errors start with, or the line
+// of YAML errors.
+var problemPosition = regexp.MustCompile(`^(\d+):(\d+): |^yaml: line (\d+): `)
+
+// Problem severities.
+const (
+	severityError   = "error"
+	severityWarning = "warning"
+)
+
+// problem is an error or warning found in a rule file.
+type problem struct {
+	file     string
+	line     int
+	column   int
+	severity string
+	message  string
+}
+
+func newProblem(file, severity string, err error) problem {
+	p := problem{file: file, severity: severity, message: strings.TrimPrefix(err.Error(), file+": ")}
+	if m := problemPosition.FindStringSubmatch(p.message); m != nil {
+		if m[3] != "" {
+			p.line, _ = strconv.Atoi(m[3])
+		} else {
+			p.line, _ = strconv.Atoi(m[1])
+			p.column, _ = strconv.Atoi(m[2])
+		}
+	}
+	return p
+}
+
+// check checks the rule files and writes the problems found to w. It returns
+// the exit code.
+func check(w io.Writer, files []string) int {
+	var (
+		problems []problem
+		parsed   = map[string]*RuleGroups{}
+	)
+	for _, file := range files {
+		rgs, errs := ParseFile(file)
+		for _, err := range errs {
+			problems = append(problems, newProblem(file, severityError, err))
+		}
+		if len(errs) == 0 {
+			parsed[file] = rgs
+		}
+	}
+	// Files with errors are not linted, their rules are unreliable.
+	problems = append(problems, lintRules(files, parsed)...)
+
+	failed := false
+	for _, p := range problems {
+		failed = failed || p.severity == severityError || *checkLintFatal
+	}
+	if err := writeProblems(w, problems); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+		return exitFailure
+	}
+	if failed {
+		return exitFailure
+	}
+	return 0
+}
+
+// lintRules finds duplicate rules and rules using series which are not
+// recorded, or recorded by a rule evaluated after them.
+func lintRules(files []string, parsed map[string]*RuleGroups) []problem {
+	recorded := map[string]struct{}{}
+	for _, rgs := range parsed {
+		for _, g := range rgs.Groups {
+			for _, r := range g.Rules {
+				if r.Record.Value != "" {
+					recorded[r.Record.Value] = struct{}{}
+				}
+			}
+		}
+	}
+
+	var problems []problem
+	for _, file := range files {
+		rgs, ok := parsed[file]
+		if !ok {
+			continue
+		}
+		for _, g := range rgs.Groups {
+			warn := func(i int, node *yaml.Node, format string, args ...interface{}) {
+				r := g.Rules[i]
+				err := &Error{
+					Group:    g.Name,
+					Rule:     i + 1,
+					RuleName: r.Alert.Value + r.Record.Value,
+					Err:      WrappedError{err: fmt.Errorf(format, args...), node: node},
+				}
+				problems = append(problems, newProblem(file, severityWarning, err))
+			}
+
+			recordedAt := map[string]int{}
+			for i, r := range g.Rules {
+				if _, ok := recordedAt[r.Record.Value]; r.Record.Value != "" && !ok {
+					recordedAt[r.Record.Value] = i
+				}
+			}
+			seen := map[string]int{}
+			for i, r := range g.Rules {
+				key := ruleKey(r)
+				if j, ok := seen[key]; ok {
+					warn(i, &g.Rules[i].Expr, "duplicate of rule %d", j+1)
+				} else {
+					seen[key] = i
+				}
+
+				expr, err := parser.ParseExpr(r.Expr.Value)
+				if err != nil {
+					continue
+				}
+				for _, name := range metricNames(expr) {
+					// Recorded series are named level:metric:operations by
+					// convention, other series come from the targets.
+					if !strings.Contains(name, ":") {
+						continue
+					}
+					j, inGroup := recordedAt[name]
+					_, anywhere := recorded[name]
+					switch {
+					case !anywhere:
+						warn(i, &g.Rules[i].Expr, "series %q is not recorded by any of the checked rules", name)
+					case inGroup && j == i:
+						warn(i, &g.Rules[i].Expr, "series %q is recorded by the rule itself", name)
+					case inGroup && j > i:
+						warn(i, &g.Rules[i].Expr, "series %q is recorded by rule %d, which is evaluated later", name, j+1)
+					}
+				}
+			}
+		}
+	}
+	return problems
+}
+
+// ruleKey identifies rules which are duplicates of each other.
+func ruleKey(r RuleNode) string {
+	b, _ := json.Marshal([]interface{}{r.Alert.Value, r.Record.Value, r.Expr.Value, r.Labels})
+	return string(b)
+}
+
+// metricNames returns the distinct metric names selected in expr.
+func metricNames(expr parser.Expr) []string {
+	var names []string
+	parser.Inspect(expr, func(node parser.Node, _ []parser.Node) error {
+		if vs, ok := node.(*parser.VectorSelector); ok && vs.Name != "" && !slices.Contains(names, vs.Name) {
+			names = append(names, vs.Name)
+		}
+		return nil
+	})
+	return names
+}
+
+// writeProblems writes the problems in the check output format.
+func writeProblems(w io.Writer, problems []problem) error {
+	switch *checkFormat {
+	case checkGitHub:
+		escape := strings.NewReplacer("%", "%25", "\r", "%0D", "\n", "%0A")
+		for _, p := range problems {
+			fmt.Fprintf(w, "::%s file=%s,line=%d,col=%d::%s\n", p.severity, p.file, position(p.line), position(p.column), escape.Replace(p.message))
+		}
+	case checkGitLab:
+		type location struct {
+			Path  string `json:"path"`
+			Lines struct {
+				Begin int `json:"begin"`
+			} `json:"lines"`
+		}
+		report := make([]struct {
+			Description string   `json:"description"`
+			CheckName   string   `json:"check_name"`
+			Fingerprint string   `json:"fingerprint"`
+			Severity    string   `json:"severity"`
+			Location    location `json:"location"`
+		}, len(problems))
+		for i, p := range problems {
+			sum := md5.Sum([]byte(p.file + "\x00" + p.message))
+			report[i].Description = p.message
+			report[i].CheckName = "prom-rules-manager/" + p.severity
+			report[i].Fingerprint = hex.EncodeToString(sum[:])
+			report[i].Severity = map[string]string{severityError: "major", severityWarning: "minor"}[p.severity]
+			report[i].Location.Path = p.file
+			report[i].Location.Lines.Begin = position(p.line)
+		}
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(report)
+	default:
+		for _, p := range problems {
+			if p.severity == severityWarning {
+				fmt.Fprintf(w, "%s: warning: %s\n", p.file, p.message)
+			} else {
+				fmt.Fprintf(w, "%s: %s\n", p.file, p.message)
+			}
+		}
+	}
+	return nil
+}
+
+// position returns n, or 1 for unknown positions.
+func position(n int) int {
+	if n < 1 {
+		return 1
+	}
+	return n
+}
+
+// Key order of formatted rule files, the order of the fields of RuleGroup and
+// RuleNode.
+var (
+	groupKeyOrder = []string{"name", "interval", "limit", "rules"}
+	ruleKeyOrder  = []string{"record", "alert", "expr", "for", "keep_firing_for", "labels", "annotations"}
+)
+
+// formatFiles formats the rule files in place, or writes the changes to w in
+// diff mode. It returns the exit code.
+func formatFiles(w io.Writer, files []string) int {
+	code := 0
+	for _, file := range files {
+		b, err := os.ReadFile(file)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", err)
+			code = exitFailure
+			continue
+		}
+		formatted, err := formatRuleFile(b)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %s\n", file, err)
+			code = exitFailure
+			continue
+		}
+		if bytes.Equal(b, formatted) {
+			continue
+		}
+		if !*fmtDiff {
+			if err := os.WriteFile(file, formatted, 0o644); err != nil {
+				fmt.Fprintf(os.Stderr, "%s\n", err)
+				code = exitFailure
+			}
+			continue
+		}
+		diff, _ := difflib.GetUnifiedDiffString(difflib.UnifiedDiff{
+			A:        difflib.SplitLines(string(b)),
+			B:        difflib.SplitLines(string(formatted)),
+			FromFile: file,
+			ToFile:   file + " (formatted)",
+			Context:  3,
+		})
+		fmt.Fprint(w, diff)
+		if code == 0 {
+			code = exitChanges
+		}
+	}
+	return code
+}
+
+// formatRuleFile formats a rule file. It works on the YAML nodes, so that
+// comments are kept.
+func formatRuleFile(b []byte) ([]byte, error) {
+	if _, errs := Parse(b); len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+	var doc yaml.Node
+	if err := yaml.Unmarshal(b, &doc); err != nil {
+		return nil, err
+	}
+	if doc.Kind != yaml.DocumentNode {
+		// Empty file.
+		return b, nil
+	}
+
+	groups := mappingValue(doc.Content[0], "groups")
+	if groups != nil {
+		for _, group := range groups.Content {
+			sortKeys(group, groupKeyOrder)
+			rules := mappingValue(group, "rules")
+			if rules == nil {
+				continue
+			}
+			for _, rule := range rules.Content {
+				sortKeys(rule, ruleKeyOrder)
+				for _, key := range []string{"labels", "annotations"} {
+					if m := mappingValue(rule, key); m != nil {
+						sortKeys(m, nil)
+					}
+				}
+				if expr := mappingValue(rule, "expr"); expr != nil {
+					if err := formatExpr(expr); err != nil {
+						return nil, err
+					}
+				}
+			}
+		}
+	}
+
+	var buf bytes.Buffer
+	enc := yaml.NewEncoder(&buf)
+	enc.SetIndent(2)
+	if err := enc.Encode(&doc); err != nil {
+		return nil, err
+	}
+	if err := enc.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// formatExpr replaces the PromQL expression of node with its pretty-printed
+// form. Multi-line expressions are written as literal blocks.
+func formatExpr(node *yaml.Node) error {
+	expr, err := parser.ParseExpr(node.Value)
+	if err != nil {
+		return fmt.Errorf("%d:%d: %w", node.Line, node.Column, err)
+	}
+	node.Value = parser.Prettify(expr)
+	node.Tag = "!!str"
+	node.Style = 0
+	if strings.Contains(node.Value, "\n") {
+		node.Style = yaml.LiteralStyle
+	}
+	return nil
+}
+
+// mappingValue returns the value of key in the mapping node, nil if it is not
+// set.
+func mappingValue(node *yaml.Node, key string) *yaml.Node {
+	if node.Kind != yaml.MappingNode {
+		return nil
+	}
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if node.Content[i].Value == key {
+			return node.Content[i+1]
+		}
+	}
+	return nil
+}
+
+// sortKeys sorts the keys of the mapping node in the given order, unknown
+// keys and all keys if order is nil alphabetically after them.
+func sortKeys(node *yaml.Node, order []string) {
+	if node.Kind != yaml.MappingNode {
+		return
+	}
+	type pair struct{ key, value *yaml.Node }
+	pairs := make([]pair, 0, len(node.Content)/2)
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		pairs = append(pairs, pair{node.Content[i], node.Content[i+1]})
+	}
+	rank := func(key string) int {
+		if i := slices.Index(order, key); i >= 0 {
+			return i
+		}
+		return len(order)
+	}
+	sort.SliceStable(pairs, func(i, j int) bool {
+		ri, rj := rank(pairs[i].key.Value), rank(pairs[j].key.Value)
+		if ri != rj {
+			return ri < rj
+		}
+		return ri == len(order) && pairs[i].key.Value < pairs[j].key.Value
+	})
+	node.Content = node.Content[:0]
+	for _, p := range pairs {
+		node.Content = append(node.Content, p.key, p.value)
+	}
+}
@@ -0,0 +1,457 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/alecthomas/kingpin"
+	"github.com/pmezard/go-difflib/difflib"
+	"gopkg.in/yaml.v3"
+)
+
+// Exit codes of the client commands.
+const (
+	// exitFailure is returned when the server cannot be reached, fails or
+	// asks to retry later, e.g. with 429 or 503.
+	exitFailure = 1
+	// exitRejected is returned when the server rejects the request, e.g.
+	// because the rules are invalid or owned by another source.
+	exitRejected = 2
+	// exitChanges is returned by diff when applying would change the rules.
+	exitChanges = 3
+)
+
+// Output formats of the client commands.
+const (
+	outputTable = "table"
+	outputYAML  = "yaml"
+	outputJSON  = "json"
+)
+
+var (
+	clientServer  string
+	clientTimeout time.Duration
+	clientOutput  string
+
+	getCmd    = outputFlag(clientCommand(kingpin.Command("get", "Print the rule groups, or the named ones.")))
+	getGroups = getCmd.Arg("group", "Names of the groups to print.").Strings()
+
+	applyCmd    = outputFlag(clientCommand(kingpin.Command("apply", "Converge the groups owned by a source to a rule file.")))
+	applyFile   = applyCmd.Flag("filename", "Rule file to apply, - reads standard input.").Short('f').Required().String()
+	applySource = applyCmd.Flag("source", "Source owning the applied groups. Groups it applied before which are missing from the file are deleted.").Default("cli").String()
+	applyForce  = applyCmd.Flag("force", "Take over groups owned by other sources or made by hand.").Bool()
+	applyDryRun = applyCmd.Flag("dry-run", "Print the plan without applying it.").Bool()
+
+	deleteCmd    = clientCommand(kingpin.Command("delete", "Delete a rule group, or the rules with the given name from it."))
+	deleteGroup  = deleteCmd.Arg("group", "Name of the group.").Required().String()
+	deleteRule   = deleteCmd.Arg("rule", "Name of the alerting or recording rules to delete. The whole group is deleted if not set.").String()
+	deleteExpr   = deleteCmd.Flag("expr", "Only delete the rules with this expression.").String()
+	deleteDryRun = deleteCmd.Flag("dry-run", "Print the diff without deleting.").Bool()
+
+	diffCmd    = clientCommand(kingpin.Command("diff", "Show the changes applying a rule file would make. Exits with 3 if there are changes."))
+	diffFile   = diffCmd.Flag("filename", "Rule file to compare, - reads standard input.").Short('f').Required().String()
+	diffSource = diffCmd.Flag("source", "Source owning the applied groups.").Default("cli").String()
+	diffForce  = diffCmd.Flag("force", "Take over groups owned by other sources or made by hand.").Bool()
+
+	exportCmd    = clientCommand(kingpin.Command("export", "Write all rule groups to standard output or a file."))
+	exportFormat = exportCmd.Flag("format", "Export format.").Default(exportYAML).Enum(exportYAML, exportJSON, exportTar)
+	exportFile   = exportCmd.Flag("output-file", "File to write to instead of standard output.").String()
+
+	historyCmd   = outputFlag(clientCommand(kingpin.Command("history", "List the recent changes, newest first.")))
+	historyLimit = historyCmd.Flag("limit", "Maximum number of changes listed, 0 lists all known ones.").Default("20").Int()
+
+	rollbackCmd      = clientCommand(kingpin.Command("rollback", "Restore the rule groups as they were after a recent revision."))
+	rollbackRevision = rollbackCmd.Arg("revision", "Revision to roll back to, as listed by history.").Required().String()
+	rollbackDryRun   = rollbackCmd.Flag("dry-run", "Print the diff without rolling back.").Bool()
+)
+
+// errChanges is returned by diff when applying would change the rules.
+var errChanges = errors.New("rules differ")
+
+// clientCommand adds the flags of the commands talking to a server to cmd.
+func clientCommand(cmd *kingpin.CmdClause) *kingpin.CmdClause {
+	cmd.Flag("server", "URL of the rules manager. Basic auth credentials may be set in the URL.").Envar("PROM_RULES_MANAGER_URL").Default("http://localhost:9090").StringVar(&clientServer)
+	cmd.Flag("timeout", "Timeout of the requests to the server.").Default("30s").DurationVar(&clientTimeout)
+	return cmd
+}
+
+// outputFlag adds the output format flag to cmd.
+func outputFlag(cmd *kingpin.CmdClause) *kingpin.CmdClause {
+	cmd.Flag("output", "Output format.").Short('o').Default(outputTable).EnumVar(&clientOutput, outputTable, outputYAML, outputJSON)
+	return cmd
+}
+
+// runClient runs a client command and returns the exit code.
+func runClient(command string) int {
+	c := &apiClient{
+		server: strings.TrimSuffix(clientServer, "/"),
+		client: &http.Client{Timeout: clientTimeout},
+	}
+	var err error
+	switch command {
+	case getCmd.FullCommand():
+		err = c.get(os.Stdout)
+	case applyCmd.FullCommand():
+		err = c.apply(os.Stdout)
+	case deleteCmd.FullCommand():
+		err = c.delete(os.Stdout)
+	case diffCmd.FullCommand():
+		err = c.diff(os.Stdout)
+	case exportCmd.FullCommand():
+		err = c.export(os.Stdout)
+	case historyCmd.FullCommand():
+		err = c.history(os.Stdout)
+	case rollbackCmd.FullCommand():
+		err = c.rollback(os.Stdout)
+	default:
+		err = fmt.Errorf("unknown command %q", command)
+	}
+
+	var apiErr *apiError
+	switch {
+	case err == nil:
+		return 0
+	case errors.Is(err, errChanges):
+		return exitChanges
+	case errors.As(err, &apiErr) && apiErr.status/100 == 4 && apiErr.status != http.StatusTooManyRequests:
+		fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+		return exitRejected
+	default:
+		fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+		return exitFailure
+	}
+}
+
+// apiError is an error status answered by the server.
+type apiError struct {
+	status  int
+	message string
+}
+
+func (e *apiError) Error() string {
+	return fmt.Sprintf("%d %s: %s", e.status, http.StatusText(e.status), e.message)
+}
+
+// apiClient calls the v1 API of a rules manager.
+type apiClient struct {
+	server string
+	client *http.Client
+}
+
+// do sends a request to the API and returns the response body.
+func (c *apiClient) do(method, path string, body []byte, contentType string) ([]byte, error) {
+	req, err := http.NewRequest(method, c.server+apiV1Prefix+path, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", "prom-rules-manager")
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	for _, warning := range resp.Header.Values("Warning") {
+		fmt.Fprintf(os.Stderr, "Warning: %s\n", warning)
+	}
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 != 2 {
+		return nil, &apiError{status: resp.StatusCode, message: strings.TrimSpace(string(b))}
+	}
+	return b, nil
+}
+
+func (c *apiClient) getJSON(path string, v interface{}) error {
+	b, err := c.do(http.MethodGet, path, nil, "")
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+func (c *apiClient) get(w io.Writer) error {
+	var groups []SimpleRuleGroup
+	if len(*getGroups) == 0 {
+		if err := c.getJSON("/groups", &groups); err != nil {
+			return err
+		}
+	}
+	for _, name := range *getGroups {
+		var group SimpleRuleGroup
+		if err := c.getJSON("/groups/"+url.PathEscape(name), &group); err != nil {
+			return err
+		}
+		groups = append(groups, group)
+	}
+
+	if clientOutput != outputTable {
+		// The output is a valid rule file.
+		return writeOutput(w, struct {
+			Groups []SimpleRuleGroup `yaml:"groups" json:"groups"`
+		}{groups})
+	}
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "GROUP\tTYPE\tNAME\tFOR\tEXPR")
+	for _, g := range groups {
+		for _, r := range g.Rules {
+			typ, name := "alert", r.Alert
+			if r.Record != "" {
+				typ, name = "record", r.Record
+			}
+			var forDuration string
+			if r.For != 0 {
+				forDuration = r.For.String()
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", g.Name, typ, name, forDuration, strings.Join(strings.Fields(r.Expr), " "))
+		}
+	}
+	return tw.Flush()
+}
+
+func (c *apiClient) apply(w io.Writer) error {
+	b, err := readRuleFile(*applyFile)
+	if err != nil {
+		return err
+	}
+	query := url.Values{"source": {*applySource}}
+	if *applyForce {
+		query.Set("force", "true")
+	}
+	if *applyDryRun {
+		query.Set("dryRun", "true")
+	}
+	resp, err := c.do(http.MethodPut, "/rules?"+query.Encode(), b, "application/yaml")
+	if err != nil {
+		return err
+	}
+	var plan ApplyPlan
+	if err := json.Unmarshal(resp, &plan); err != nil {
+		return err
+	}
+
+	if clientOutput != outputTable {
+		return writeOutput(w, plan)
+	}
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "ACTION\tGROUP")
+	for _, action := range []struct {
+		name   string
+		groups []string
+	}{{"add", plan.Add}, {"update", plan.Update}, {"delete", plan.Delete}, {"unchanged", plan.Unchanged}} {
+		for _, g := range action.groups {
+			fmt.Fprintf(tw, "%s\t%s\n", action.name, g)
+		}
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	if plan.Applied {
+		fmt.Fprintf(w, "Rules of source %s are applied.\n", plan.Source)
+	} else {
+		fmt.Fprintf(w, "Dry run, nothing is applied.\n")
+	}
+	return nil
+}
+
+func (c *apiClient) delete(w io.Writer) error {
+	path := "/groups/" + url.PathEscape(*deleteGroup)
+	query := url.Values{}
+	if *deleteRule != "" {
+		path += "/rules/" + url.PathEscape(*deleteRule)
+		if *deleteExpr != "" {
+			query.Set("expr", *deleteExpr)
+		}
+	}
+	if *deleteDryRun {
+		query.Set("dryRun", "true")
+	}
+	if len(query) > 0 {
+		path += "?" + query.Encode()
+	}
+	resp, err := c.do(http.MethodDelete, path, nil, "")
+	if err != nil {
+		return err
+	}
+	return writeResult(w, resp, *deleteDryRun)
+}
+
+// diff prints a unified diff per group applying the rule file would change.
+func (c *apiClient) diff(w io.Writer) error {
+	b, err := readRuleFile(*diffFile)
+	if err != nil {
+		return err
+	}
+	desired, errs := Parse(b)
+	if len(errs) > 0 {
+		for _, err := range errs {
+			fmt.Fprintf(os.Stderr, "%s\n", strings.TrimSpace(err.Error()))
+		}
+		return &apiError{status: http.StatusBadRequest, message: "rule file has errors"}
+	}
+
+	query := url.Values{"source": {*diffSource}, "dryRun": {"true"}}
+	if *diffForce {
+		query.Set("force", "true")
+	}
+	resp, err := c.do(http.MethodPut, "/rules?"+query.Encode(), b, "application/yaml")
+	if err != nil {
+		return err
+	}
+	var plan ApplyPlan
+	if err := json.Unmarshal(resp, &plan); err != nil {
+		return err
+	}
+	var live []SimpleRuleGroup
+	if err := c.getJSON("/groups", &live); err != nil {
+		return err
+	}
+
+	groups := func(groups []SimpleRuleGroup) map[string]SimpleRuleGroup {
+		m := make(map[string]SimpleRuleGroup, len(groups))
+		for _, g := range groups {
+			m[g.Name] = g
+		}
+		return m
+	}
+	liveGroups := groups(live)
+	desiredGroups := map[string]SimpleRuleGroup{}
+	for _, g := range desired.Groups {
+		desiredGroups[g.Name] = newSimpleRuleGroup(g)
+	}
+
+	changed := false
+	for _, names := range [][]string{plan.Add, plan.Update, plan.Delete} {
+		for _, name := range names {
+			from, err := groupYAML(liveGroups, name)
+			if err != nil {
+				return err
+			}
+			to, err := groupYAML(desiredGroups, name)
+			if err != nil {
+				return err
+			}
+			diff, _ := difflib.GetUnifiedDiffString(difflib.UnifiedDiff{
+				A:        splitLines(from),
+				B:        splitLines(to),
+				FromFile: "live/" + name,
+				ToFile:   "file/" + name,
+				Context:  3,
+			})
+			fmt.Fprint(w, diff)
+			changed = true
+		}
+	}
+	if changed {
+		return errChanges
+	}
+	return nil
+}
+
+// groupYAML returns the named group as a rule file, empty if there is no such
+// group.
+func groupYAML(groups map[string]SimpleRuleGroup, name string) (string, error) {
+	g, ok := groups[name]
+	if !ok {
+		return "", nil
+	}
+	b, err := yaml.Marshal(&RuleGroups{Groups: []RuleGroup{newRuleGroupNode(g)}})
+	return string(b), err
+}
+
+// splitLines splits s for difflib, an empty s has no lines.
+func splitLines(s string) []string {
+	if s == "" {
+		return nil
+	}
+	return difflib.SplitLines(s)
+}
+
+func (c *apiClient) export(w io.Writer) error {
+	resp, err := c.do(http.MethodGet, "/export?format="+url.QueryEscape(*exportFormat), nil, "")
+	if err != nil {
+		return err
+	}
+	if *exportFile != "" {
+		return os.WriteFile(*exportFile, resp, 0o644)
+	}
+	_, err = w.Write(resp)
+	return err
+}
+
+func (c *apiClient) history(w io.Writer) error {
+	var events []WatchEvent
+	if err := c.getJSON(fmt.Sprintf("/history?limit=%d", *historyLimit), &events); err != nil {
+		return err
+	}
+
+	if clientOutput != outputTable {
+		return writeOutput(w, events)
+	}
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "REVISION\tTIME\tACTOR\tCHANGES\tDESCRIPTION")
+	for _, ev := range events {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t+%d ~%d -%d\t%s\n", ev.Revision, ev.Time.Format(time.RFC3339), ev.Actor,
+			len(ev.Added), len(ev.Updated), len(ev.Removed), ev.Description)
+	}
+	return tw.Flush()
+}
+
+func (c *apiClient) rollback(w io.Writer) error {
+	path := "/history/" + url.PathEscape(*rollbackRevision) + "/rollback"
+	if *rollbackDryRun {
+		path += "?dryRun=true"
+	}
+	resp, err := c.do(http.MethodPost, path, nil, "")
+	if err != nil {
+		return err
+	}
+	return writeResult(w, resp, *rollbackDryRun)
+}
+
+// readRuleFile reads the named file, or standard input for -.
+func readRuleFile(name string) ([]byte, error) {
+	if name == "-" {
+		return io.ReadAll(os.Stdin)
+	}
+	return os.ReadFile(name)
+}
+
+// writeOutput writes v in the YAML or JSON output format.
+func writeOutput(w io.Writer, v interface{}) error {
+	if clientOutput == outputJSON {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(v)
+	}
+	enc := yaml.NewEncoder(w)
+	enc.SetIndent(2)
+	return enc.Encode(v)
+}
+
+// writeResult writes the response to a write, the diff of a dry run.
+func writeResult(w io.Writer, resp []byte, dryRun bool) error {
+	if !dryRun {
+		_, err := w.Write(resp)
+		return err
+	}
+	var result DryRunResult
+	if err := json.Unmarshal(resp, &result); err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "%s (dry run)\n%s", result.Description, result.Diff)
+	return nil
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/alecthomas/kingpin"
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/prometheus/prometheus/promql/parser"
+)
+
+// Conflict kinds.
+const (
+	// conflictDuplicateAlert is an alert name defined more than once with
+	// label sets which do not tell the alerts apart.
+	conflictDuplicateAlert = "duplicate-alert"
+	// conflictDuplicateSeries is recording rules writing the same series.
+	conflictDuplicateSeries = "duplicate-series"
+	// conflictEquivalentExpr is rules under different names computing the
+	// same expression.
+	conflictEquivalentExpr = "equivalent-expr"
+)
+
+// Conflict policies.
+const (
+	conflictIgnore = "ignore"
+	conflictWarn   = "warn"
+	conflictReject = "reject"
+)
+
+var (
+	conflictPolicy          = kingpin.Flag("rules.conflict-policy", "What to do with writes introducing duplicate or conflicting rules: ignore, warn or reject them.").Default(conflictWarn).Enum(conflictIgnore, conflictWarn, conflictReject)
+	conflictPolicyOverrides = kingpin.Flag("rules.conflict-policy-override", "Policy for a kind of conflict, as kind=policy. Kinds are duplicate-alert, duplicate-series and equivalent-expr. May be repeated.").StringMap()
+)
+
+// errRuleConflict is returned for writes introducing conflicts the policy
+// rejects.
+var errRuleConflict = errors.New("rules conflict with existing rules")
+
+func init() {
+	onChange(func(c Change) {
+		counts := map[string]int{conflictDuplicateAlert: 0, conflictDuplicateSeries: 0, conflictEquivalentExpr: 0}
+		for _, conflict := range findConflicts(c.After) {
+			counts[conflict.Kind]++
+		}
+		for kind, n := range counts {
+			ruleConflicts.WithLabelValues(kind).Set(float64(n))
+		}
+	})
+}
+
+// Conflict is a set of rules which duplicate or contradict each other.
+type Conflict struct {
+	Kind    string    `json:"kind"`
+	Policy  string    `json:"policy"`
+	Message string    `json:"message"`
+	Rules   []RuleRef `json:"rules"`
+}
+
+// key identifies the conflict between the same rules.
+func (c Conflict) key() string {
+	b, _ := json.Marshal([]interface{}{c.Kind, c.Rules})
+	return string(b)
+}
+
+// validateConflictPolicies checks the policy overrides.
+func validateConflictPolicies() error {
+	for kind, policy := range *conflictPolicyOverrides {
+		switch kind {
+		case conflictDuplicateAlert, conflictDuplicateSeries, conflictEquivalentExpr:
+		default:
+			return fmt.Errorf("unknown conflict kind %q", kind)
+		}
+		switch policy {
+		case conflictIgnore, conflictWarn, conflictReject:
+		default:
+			return fmt.Errorf("unknown conflict policy %q for %s", policy, kind)
+		}
+	}
+	return nil
+}
+
+// policyFor returns the policy applying to the kind of conflict.
+func policyFor(kind string) string {
+	if policy, ok := (*conflictPolicyOverrides)[kind]; ok {
+		return policy
+	}
+	return *conflictPolicy
+}
+
+// conflictRule is a rule with the keys the analysis compares.
+type conflictRule struct {
+	ref RuleRef
+	// ast is the canonical form of the parsed expression.
+	ast string
+	// labels is the canonical form of the labels.
+	labels string
+}
+
+// findConflicts returns the pairs of rules across all groups which duplicate
+// or contradict each other.
+func findConflicts(groups []SimpleRuleGroup) []Conflict {
+	var (
+		alerts  = map[string][]conflictRule{}
+		records = map[string][]conflictRule{}
+		exprs   = map[string][]conflictRule{}
+	)
+	for _, g := range groups {
+		for _, r := range g.Rules {
+			labels, _ := json.Marshal(r.Labels)
+			if len(r.Labels) == 0 {
+				labels = nil
+			}
+			cr := conflictRule{
+				ref:    RuleRef{Group: g.Name, Type: "alert", Name: r.Alert, Expr: r.Expr, Labels: r.Labels},
+				ast:    r.Expr,
+				labels: string(labels),
+			}
+			if e, err := parser.ParseExpr(r.Expr); err == nil {
+				cr.ast = e.String()
+			}
+			if r.Record != "" {
+				cr.ref.Type, cr.ref.Name = "record", r.Record
+				records[r.Record] = append(records[r.Record], cr)
+			} else {
+				alerts[r.Alert] = append(alerts[r.Alert], cr)
+			}
+			k := cr.ref.Type + "\x00" + cr.ast + "\x00" + cr.labels
+			exprs[k] = append(exprs[k], cr)
+		}
+	}
+
+	var conflicts []Conflict
+	pairs := func(rules map[string][]conflictRule, kind string, conflicting func(a, b conflictRule) bool, message func(a, b conflictRule) string) {
+		for _, rs := range rules {
+			for i := range rs {
+				for j := i + 1; j < len(rs); j++ {
+					if !conflicting(rs[i], rs[j]) {
+						continue
+					}
+					conflicts = append(conflicts, Conflict{
+						Kind:    kind,
+						Policy:  policyFor(kind),
+						Message: message(rs[i], rs[j]),
+						Rules:   []RuleRef{rs[i].ref, rs[j].ref},
+					})
+				}
+			}
+		}
+	}
+	pairs(alerts, conflictDuplicateAlert,
+		func(a, b conflictRule) bool { return labelsOverlap(a.ref.Labels, b.ref.Labels) },
+		func(a, b conflictRule) string {
+			if a.ref.Group == b.ref.Group {
+				return fmt.Sprintf("alert %q is defined twice in group %q with labels which do not tell the alerts apart", a.ref.Name, a.ref.Group)
+			}
+			return fmt.Sprintf("alert %q is defined in groups %q and %q with labels which do not tell the alerts apart", a.ref.Name, a.ref.Group, b.ref.Group)
+		})
+	pairs(records, conflictDuplicateSeries,
+		func(a, b conflictRule) bool { return a.labels == b.labels },
+		func(a, b conflictRule) string {
+			if a.ref.Group == b.ref.Group {
+				return fmt.Sprintf("recording rules in group %q both write the series %q", a.ref.Group, a.ref.Name)
+			}
+			return fmt.Sprintf("recording rules in groups %q and %q both write the series %q", a.ref.Group, b.ref.Group, a.ref.Name)
+		})
+	pairs(exprs, conflictEquivalentExpr,
+		func(a, b conflictRule) bool { return a.ref.Name != b.ref.Name },
+		func(a, b conflictRule) string {
+			return fmt.Sprintf("%s rules %q in group %q and %q in group %q compute the same expression", a.ref.Type, a.ref.Name, a.ref.Group, b.ref.Name, b.ref.Group)
+		})
+
+	sort.SliceStable(conflicts, func(i, j int) bool {
+		if conflicts[i].Kind != conflicts[j].Kind {
+			return conflicts[i].Kind < conflicts[j].Kind
+		}
+		return conflicts[i].Message < conflicts[j].Message
+	})
+	return conflicts
+}
+
+// labelsOverlap reports whether the label sets agree on all the labels they
+// both set, so that neither tells the alerts apart.
+func labelsOverlap(a, b map[string]string) bool {
+	for name, value := range a {
+		if v, ok := b[name]; ok && v != value {
+			return false
+		}
+	}
+	return true
+}
+
+// newConflicts returns the conflicts of after which are not in before.
+func newConflicts(before, after []Conflict) []Conflict {
+	known := make(map[string]struct{}, len(before))
+	for _, c := range before {
+		known[c.key()] = struct{}{}
+	}
+	var added []Conflict
+	for _, c := range after {
+		if _, ok := known[c.key()]; !ok {
+			added = append(added, c)
+		}
+	}
+	return added
+}
+
+// checkConflicts applies the policies to the conflicts the write introduced.
+// It returns the conflicts of the rule groups and the introduced ones the
+// policy warns about, and an error if the write must be rejected.
+func checkConflicts(logger log.Logger, before []Conflict, groups *RuleGroups) ([]Conflict, []Conflict, error) {
+	after := findConflicts(snapshot(groups))
+	var warnings []Conflict
+	var rejected []string
+	for _, c := range newConflicts(before, after) {
+		switch c.Policy {
+		case conflictWarn:
+			level.Warn(logger).Log("msg", "Write introduces conflicting rules", "kind", c.Kind, "conflict", c.Message)
+			warnings = append(warnings, c)
+		case conflictReject:
+			ruleConflictRejections.WithLabelValues(c.Kind).Inc()
+			rejected = append(rejected, c.Message)
+		}
+	}
+	if len(rejected) > 0 {
+		return nil, nil, fmt.Errorf("%w: %s", errRuleConflict, strings.Join(rejected, "; "))
+	}
+	return after, warnings, nil
+}
+
+// apply applies op, reverting it if it fails, edits groups generated from
+// SLOs or introduces conflicts the policy rejects. conflicts are the conflicts
+// before op, the ones after it are returned along with the introduced ones
+// the policy warns about, which are logged to logger.
+func (manager *RulesManager) apply(logger log.Logger, op writeOp, conflicts []Conflict) ([]Conflict, []Conflict, error) {
+	restore := manager.checkpoint()
+	generated := manager.generatedGroups()
+	var after, warnings []Conflict
+	err := op.mutate(manager)
+	if err == nil {
+		err = manager.checkGeneratedGroups(generated)
+	}
+	if err == nil {
+		after, warnings, err = checkConflicts(logger, conflicts, manager.ruleGroups)
+	}
+	if err != nil {
+		restore()
+		return conflicts, nil, err
+	}
+	return after, warnings, nil
+}
+
+// conflicts lists the conflicts between the current rules.
+func (h *Handler) conflicts(w http.ResponseWriter, r *http.Request) {
+	rulesManager, err := NewCachedRulesManager()
+	if err != nil {
+		h.writeError(w, "Rules cannot be read", err)
+		return
+	}
+	conflicts := findConflicts(snapshot(rulesManager.ruleGroups))
+	if conflicts == nil {
+		conflicts = []Conflict{}
+	}
+	writeJSON(w, http.StatusOK, conflicts)
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/go-kit/log"
+)
+
+func TestFindConflicts(t *testing.T) {
+	defer func(policy string) { *conflictPolicy = policy }(*conflictPolicy)
+	*conflictPolicy = conflictWarn
+
+	alert := func(name, expr string, labels map[string]string) Rule {
+		return Rule{Alert: name, Expr: expr, Labels: labels}
+	}
+	record := func(name, expr string) Rule {
+		return Rule{Record: name, Expr: expr}
+	}
+
+	for _, tc := range []struct {
+		name   string
+		groups []SimpleRuleGroup
+		want   [][]string
+		// message is the message of the first conflict, if set.
+		message string
+	}{
+		{
+			name: "distinct rules",
+			groups: []SimpleRuleGroup{
+				{Name: "a", Rules: []Rule{alert("Down", "up == 0", nil), record("job:up", "sum(up)")}},
+				{Name: "b", Rules: []Rule{record("job:down", "sum(1 - up)")}},
+			},
+		},
+		{
+			name: "alerts told apart by labels",
+			groups: []SimpleRuleGroup{
+				{Name: "a", Rules: []Rule{alert("Down", `up{job="a"} == 0`, map[string]string{"team": "a"})}},
+				{Name: "b", Rules: []Rule{alert("Down", `up{job="b"} == 0`, map[string]string{"team": "b"})}},
+			},
+		},
+		{
+			name: "duplicate alert",
+			groups: []SimpleRuleGroup{
+				{Name: "a", Rules: []Rule{alert("Down", `up{job="a"} == 0`, map[string]string{"severity": "page"})}},
+				{Name: "b", Rules: []Rule{alert("Down", `up{job="b"} == 0`, nil)}},
+			},
+			want:    [][]string{{conflictDuplicateAlert, "a/Down", "b/Down"}},
+			message: `alert "Down" is defined in groups "a" and "b" with labels which do not tell the alerts apart`,
+		},
+		{
+			name: "duplicate alert in a group",
+			groups: []SimpleRuleGroup{
+				{Name: "a", Rules: []Rule{alert("Down", `up{job="a"} == 0`, nil), alert("Down", `up{job="b"} == 0`, nil)}},
+			},
+			want:    [][]string{{conflictDuplicateAlert, "a/Down", "a/Down"}},
+			message: `alert "Down" is defined twice in group "a" with labels which do not tell the alerts apart`,
+		},
+		{
+			name: "duplicate series",
+			groups: []SimpleRuleGroup{
+				{Name: "a", Rules: []Rule{record("job:up", "sum by (job) (up)")}},
+				{Name: "b", Rules: []Rule{record("job:up", "max by (job) (up)")}},
+			},
+			want: [][]string{{conflictDuplicateSeries, "a/job:up", "b/job:up"}},
+		},
+		{
+			name: "equivalent expressions ignoring formatting",
+			groups: []SimpleRuleGroup{
+				{Name: "a", Rules: []Rule{record("job:up", "sum by (job) (up)")}},
+				{Name: "b", Rules: []Rule{record("job:up:sum", "sum by(job)(\n  up\n)")}},
+			},
+			want: [][]string{{conflictEquivalentExpr, "a/job:up", "b/job:up:sum"}},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var got [][]string
+			conflicts := findConflicts(tc.groups)
+			if tc.message != "" && len(conflicts) > 0 && conflicts[0].Message != tc.message {
+				t.Errorf("message = %q, want %q", conflicts[0].Message, tc.message)
+			}
+			for _, c := range conflicts {
+				if c.Policy != conflictWarn {
+					t.Errorf("conflict %q has policy %q, want %q", c.Message, c.Policy, conflictWarn)
+				}
+				conflict := []string{c.Kind}
+				for _, r := range c.Rules {
+					conflict = append(conflict, r.Group+"/"+r.Name)
+				}
+				got = append(got, conflict)
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("conflicts = %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestCheckConflicts(t *testing.T) {
+	defer func(policy string, overrides map[string]string) {
+		*conflictPolicy, *conflictPolicyOverrides = policy, overrides
+	}(*conflictPolicy, *conflictPolicyOverrides)
+	*conflictPolicy = conflictWarn
+	*conflictPolicyOverrides = map[string]string{conflictEquivalentExpr: conflictIgnore}
+
+	before := findConflicts([]SimpleRuleGroup{
+		{Name: "a", Rules: []Rule{{Record: "job:up", Expr: "sum(up)"}}},
+		{Name: "b", Rules: []Rule{{Record: "job:up", Expr: "max(up)"}}},
+	})
+	manager := newTestManager(
+		SimpleRuleGroup{Name: "a", Rules: []Rule{{Record: "job:up", Expr: "sum(up)"}}},
+		SimpleRuleGroup{Name: "b", Rules: []Rule{{Record: "job:up", Expr: "max(up)"}, {Record: "job:up:max", Expr: "max(up)"}}},
+		SimpleRuleGroup{Name: "c", Rules: []Rule{{Alert: "Down", Expr: "up == 0"}, {Alert: "Down", Expr: "absent(up)"}}},
+	)
+
+	after, warnings, err := checkConflicts(log.NewNopLogger(), before, manager.ruleGroups)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(after) != 3 {
+		t.Errorf("%d conflicts, want 3", len(after))
+	}
+	// The duplicate series existed before and the equivalent expression is
+	// ignored.
+	if len(warnings) != 1 || warnings[0].Kind != conflictDuplicateAlert {
+		t.Errorf("warnings = %+v, want the duplicate alert", warnings)
+	}
+
+	*conflictPolicyOverrides = map[string]string{conflictDuplicateAlert: conflictReject}
+	if _, _, err := checkConflicts(log.NewNopLogger(), before, manager.ruleGroups); err == nil {
+		t.Error("rejected conflict was accepted")
+	}
+}
@@ -0,0 +1,474 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/alecthomas/kingpin"
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/pmezard/go-difflib/difflib"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/util/retry"
+)
+
+// checksumAnnotation stores the checksum of the rule file last written by the
+// manager on every shard.
+const checksumAnnotation = annotationPrefix + "checksum"
+
+// driftActor is the actor of the changes adopted from drift.
+const driftActor = "drift-reconciler"
+
+// Drift policies.
+const (
+	// driftReport only reports drift.
+	driftReport = "report"
+	// driftRevert writes back the rule file last written by the manager.
+	driftRevert = "revert"
+	// driftAdopt accepts the drifted rule file as a change.
+	driftAdopt = "adopt"
+)
+
+var (
+	driftPolicy   = kingpin.Flag("drift.policy", "What to do when the rules ConfigMap is modified outside of the manager, one of report, revert or adopt.").Default(driftReport).Enum(driftReport, driftRevert, driftAdopt)
+	driftInterval = kingpin.Flag("drift.interval", "Interval between drift checks of the rules ConfigMap. 0 disables drift detection.").Default("30s").Duration()
+)
+
+// writtenSuffix is appended to the name of a shard's ConfigMap to name the
+// ConfigMap holding the rule file last written to it, so that drift can still
+// be reverted after a restart or by another replica.
+const writtenSuffix = "-written"
+
+var (
+	writtenMtx sync.Mutex
+	// written holds the rule file last written by the manager per ConfigMap.
+	written = map[string]string{}
+	// unpersisted holds the ConfigMaps whose rule file in written is not
+	// stored yet.
+	unpersisted = map[string]struct{}{}
+	// writtenChanged wakes up persistWrittenLoop, started once.
+	writtenChanged     = make(chan struct{}, 1)
+	persistWrittenOnce sync.Once
+)
+
+// checksum returns the checksum of a rule file.
+func checksum(content string) string {
+	sum := sha256.Sum256([]byte(content))
+	return hex.EncodeToString(sum[:])
+}
+
+// recordWritten remembers content as the rule file last written to
+// configMap when drift detection is enabled. If it changed, it is stored
+// along with the ConfigMap in the background, not to slow down writes.
+func recordWritten(configMap, content string) {
+	if *driftInterval <= 0 {
+		return
+	}
+	writtenMtx.Lock()
+	if previous, ok := written[configMap]; ok && previous == content {
+		writtenMtx.Unlock()
+		return
+	}
+	written[configMap] = content
+	unpersisted[configMap] = struct{}{}
+	writtenMtx.Unlock()
+
+	persistWrittenOnce.Do(func() { go persistWrittenLoop() })
+	select {
+	case writtenChanged <- struct{}{}:
+	default:
+	}
+}
+
+// persistWrittenLoop stores the rule files recorded by recordWritten. Only the
+// latest rule file of a ConfigMap is stored.
+func persistWrittenLoop() {
+	for range writtenChanged {
+		writtenMtx.Lock()
+		pending := make(map[string]string, len(unpersisted))
+		for configMap := range unpersisted {
+			pending[configMap] = written[configMap]
+		}
+		unpersisted = map[string]struct{}{}
+		writtenMtx.Unlock()
+
+		for configMap, content := range pending {
+			if err := persistWritten(configMap, content); err != nil {
+				// Drift of the ConfigMap cannot be reverted by another
+				// replica until the next write.
+				level.Warn(logger).Log("msg", "Unable to store the rule file last written", "configmap", configMap, "err", err)
+			}
+		}
+	}
+}
+
+// lastWritten returns the rule file last written to configMap, if known.
+func lastWritten(configMap string) (string, bool) {
+	writtenMtx.Lock()
+	content, ok := written[configMap]
+	writtenMtx.Unlock()
+	if ok {
+		return content, true
+	}
+	clientset, err := getClientset()
+	if err != nil {
+		return "", false
+	}
+	cm, err := clientset.CoreV1().ConfigMaps(namespace).Get(context.TODO(), configMap+writtenSuffix, metav1.GetOptions{})
+	if err != nil {
+		if !apierrors.IsNotFound(err) {
+			level.Warn(logger).Log("msg", "Unable to read the rule file last written", "configmap", configMap, "err", err)
+		}
+		return "", false
+	}
+	content, ok = cm.Data[configMap]
+	if !ok {
+		return "", false
+	}
+	writtenMtx.Lock()
+	defer writtenMtx.Unlock()
+	// Keep a rule file written in the meantime.
+	if current, found := written[configMap]; found {
+		return current, true
+	}
+	written[configMap] = content
+	return content, true
+}
+
+// persistWritten stores content as the rule file last written to configMap.
+func persistWritten(configMap, content string) error {
+	clientset, err := getClientset()
+	if err != nil {
+		return err
+	}
+	name := configMap + writtenSuffix
+	retriable := func(err error) bool {
+		return apierrors.IsConflict(err) || apierrors.IsAlreadyExists(err)
+	}
+	return retry.OnError(retry.DefaultRetry, retriable, func() error {
+		cm, err := clientset.CoreV1().ConfigMaps(namespace).Get(context.TODO(), name, metav1.GetOptions{})
+		if apierrors.IsNotFound(err) {
+			cm = &corev1.ConfigMap{
+				ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: namespace},
+				Data:       map[string]string{configMap: content},
+			}
+			_, err = clientset.CoreV1().ConfigMaps(namespace).Create(context.TODO(), cm, metav1.CreateOptions{})
+			return err
+		}
+		if err != nil {
+			return err
+		}
+		cm.Data = map[string]string{configMap: content}
+		_, err = clientset.CoreV1().ConfigMaps(namespace).Update(context.TODO(), cm, metav1.UpdateOptions{})
+		return err
+	})
+}
+
+// revertOp replaces the groups of the shard stored in configMap with the ones
+// of content, the rule file last written to it.
+func revertOp(configMap, content string) writeOp {
+	return writeOp{
+		description: fmt.Sprintf("Revert changes made outside of the manager to %s", configMap),
+		mutate: func(manager *RulesManager) error {
+			i := -1
+			for j, s := range manager.shards {
+				if s.configMap == configMap {
+					i = j
+				}
+			}
+			if i < 0 {
+				return fmt.Errorf("%s is not a rules ConfigMap", configMap)
+			}
+			baseline, errs := Parse([]byte(content))
+			if len(errs) > 0 {
+				return fmt.Errorf("rule file last written to %s: %w", configMap, errs[0])
+			}
+			live := map[string]struct{}{}
+			for name, j := range manager.groupShards {
+				if j == i {
+					live[name] = struct{}{}
+				}
+			}
+			groups := manager.ruleGroups.Groups[:0]
+			for _, g := range manager.ruleGroups.Groups {
+				if _, ok := live[g.Name]; !ok {
+					groups = append(groups, g)
+				}
+			}
+			for _, g := range baseline.Groups {
+				manager.groupShards[g.Name] = i
+				groups = append(groups, g)
+			}
+			manager.ruleGroups.Groups = groups
+			return nil
+		},
+	}
+}
+
+// ShardDrift describes the drift of a shard.
+type ShardDrift struct {
+	ConfigMap string   `json:"configMap"`
+	Drifted   bool     `json:"drifted"`
+	Added     []string `json:"added,omitempty"`
+	Updated   []string `json:"updated,omitempty"`
+	Removed   []string `json:"removed,omitempty"`
+	// Diff is a unified diff from the last written to the live rule file. It
+	// is empty if the last written rule file is unknown, e.g. because it
+	// could not be stored.
+	Diff   string `json:"diff,omitempty"`
+	Action string `json:"action,omitempty"`
+}
+
+// DriftStatus describes the last drift check.
+type DriftStatus struct {
+	CheckedAt time.Time    `json:"checkedAt"`
+	Policy    string       `json:"policy"`
+	Drifted   bool         `json:"drifted"`
+	Shards    []ShardDrift `json:"shards"`
+	Error     string       `json:"error,omitempty"`
+}
+
+// DriftReconciler detects changes of the rules ConfigMap made outside of the
+// manager, e.g. with kubectl edit, by comparing the live rule file with the
+// checksum the manager wrote along with it.
+type DriftReconciler struct {
+	logger   log.Logger
+	policy   string
+	interval time.Duration
+	queue    *WriteQueue
+
+	mtx    sync.Mutex
+	status DriftStatus
+	// reported holds the checksum of the drifted rule file an event was
+	// last emitted for per ConfigMap.
+	reported map[string]string
+}
+
+// NewDriftReconciler returns a DriftReconciler with the configured policy,
+// reverting drift through queue.
+func NewDriftReconciler(logger log.Logger, queue *WriteQueue) *DriftReconciler {
+	return &DriftReconciler{
+		logger:   logger,
+		queue:    queue,
+		policy:   *driftPolicy,
+		interval: *driftInterval,
+		status:   DriftStatus{Policy: *driftPolicy, Shards: []ShardDrift{}},
+		reported: map[string]string{},
+	}
+}
+
+// Run checks for drift every interval until ctx is canceled.
+func (d *DriftReconciler) Run(ctx context.Context) error {
+	ticker := time.NewTicker(d.interval)
+	defer ticker.Stop()
+
+	for {
+		d.check(ctx)
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// Status returns the result of the last drift check.
+func (d *DriftReconciler) Status() DriftStatus {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	return d.status
+}
+
+func (d *DriftReconciler) check(ctx context.Context) {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+
+	d.status.CheckedAt = time.Now()
+	shards, err := d.reconcile(ctx)
+	if err != nil {
+		level.Error(d.logger).Log("msg", "Drift check failed", "err", err)
+		d.status.Error = err.Error()
+		return
+	}
+	d.status.Error = ""
+	d.status.Shards = shards
+	d.status.Drifted = false
+	for _, s := range shards {
+		if s.Drifted {
+			d.status.Drifted = true
+		}
+	}
+}
+
+// reconcile compares every shard with the rule file last written to it and
+// applies the policy to the drifted ones.
+func (d *DriftReconciler) reconcile(ctx context.Context) ([]ShardDrift, error) {
+	clientset, err := getClientset()
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		shards        = []ShardDrift{}
+		before, after []SimpleRuleGroup
+		adopted       []*shard
+	)
+	for _, s := range newShards() {
+		start := time.Now()
+		cm, err := clientset.CoreV1().ConfigMaps(namespace).Get(ctx, s.configMap, metav1.GetOptions{})
+		observeConfigMap("read", start, err)
+		if apierrors.IsNotFound(err) {
+			// Nothing was written yet.
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		live := cm.Data[s.key]
+		s.resourceVersion = cm.ResourceVersion
+		s.content = live
+		s.annotations = cm.Annotations
+
+		baseline, known := lastWritten(s.configMap)
+		sum, ok := cm.Annotations[checksumAnnotation]
+		drift := ShardDrift{ConfigMap: s.configMap}
+		if !ok || sum == checksum(live) {
+			// The ConfigMap predates drift detection or holds what the
+			// manager, possibly another replica, wrote last.
+			recordWritten(s.configMap, live)
+			delete(d.reported, s.configMap)
+			configMapDrift.WithLabelValues(s.configMap).Set(0)
+			shards = append(shards, drift)
+			liveGroups := parseSnapshot(live)
+			before = append(before, liveGroups...)
+			after = append(after, liveGroups...)
+			continue
+		}
+
+		drift.Drifted = true
+		configMapDrift.WithLabelValues(s.configMap).Set(1)
+		liveGroups := parseSnapshot(live)
+		baselineGroups := liveGroups
+		if known && checksum(baseline) == sum {
+			baselineGroups = parseSnapshot(baseline)
+			drift.Added, drift.Updated, drift.Removed = diffGroups(baselineGroups, liveGroups)
+			drift.Diff, _ = difflib.GetUnifiedDiffString(difflib.UnifiedDiff{
+				A:        difflib.SplitLines(baseline),
+				B:        difflib.SplitLines(live),
+				FromFile: "written/" + s.key,
+				ToFile:   "live/" + s.key,
+				Context:  3,
+			})
+		} else {
+			known = false
+		}
+		before = append(before, baselineGroups...)
+		after = append(after, liveGroups...)
+
+		if d.reported[s.configMap] != checksum(live) {
+			d.reported[s.configMap] = checksum(live)
+			configMapDriftDetected.Inc()
+			level.Warn(d.logger).Log("msg", "Rules ConfigMap was modified outside of the manager", "configmap", s.configMap, "policy", d.policy)
+			d.event(ctx, cm, fmt.Sprintf("%s was modified outside of the manager, drift policy is %s", s.key, d.policy))
+		}
+
+		switch d.policy {
+		case driftRevert:
+			if !known {
+				drift.Action = "none: the rule file last written is unknown"
+				break
+			}
+			// The revert is written like any other change.
+			if err := d.queue.Submit(ctx, driftActor, revertOp(s.configMap, baseline)); err != nil {
+				drift.Action = fmt.Sprintf("revert failed: %s", err)
+				break
+			}
+			drift.Action = "reverted"
+			configMapDrift.WithLabelValues(s.configMap).Set(0)
+			delete(d.reported, s.configMap)
+		case driftAdopt:
+			err := s.updateConfigMap(map[string]interface{}{
+				"metadata": map[string]interface{}{
+					"resourceVersion": s.resourceVersion,
+					"annotations":     map[string]interface{}{checksumAnnotation: checksum(live)},
+				},
+			})
+			if err != nil {
+				drift.Action = fmt.Sprintf("adopt failed: %s", err)
+				break
+			}
+			recordWritten(s.configMap, live)
+			drift.Action = "adopted"
+			adopted = append(adopted, s)
+		}
+		if drift.Action != "" {
+			level.Info(d.logger).Log("msg", "Drift handled", "configmap", s.configMap, "action", drift.Action)
+		}
+		shards = append(shards, drift)
+	}
+
+	if len(adopted) > 0 {
+		// Adopted drift is recorded like any other change.
+		for _, s := range adopted {
+			configMapDrift.WithLabelValues(s.configMap).Set(0)
+			delete(d.reported, s.configMap)
+		}
+		notifyChange(Change{
+			Time:        time.Now(),
+			Actor:       driftActor,
+			Description: fmt.Sprintf("Adopt changes made outside of the manager to %d ConfigMaps", len(adopted)),
+			Before:      before,
+			After:       after,
+		})
+	}
+	return shards, nil
+}
+
+// event emits a warning event about drift of cm.
+func (d *DriftReconciler) event(ctx context.Context, cm *corev1.ConfigMap, message string) {
+	clientset, err := getClientset()
+	if err != nil {
+		return
+	}
+	now := metav1.Now()
+	_, err = clientset.CoreV1().Events(namespace).Create(ctx, &corev1.Event{
+		ObjectMeta: metav1.ObjectMeta{
+			GenerateName: cm.Name + "-",
+			Namespace:    namespace,
+		},
+		InvolvedObject: corev1.ObjectReference{
+			APIVersion:      "v1",
+			Kind:            "ConfigMap",
+			Name:            cm.Name,
+			Namespace:       namespace,
+			UID:             cm.UID,
+			ResourceVersion: cm.ResourceVersion,
+		},
+		Reason:         "RulesDrifted",
+		Message:        message,
+		Type:           corev1.EventTypeWarning,
+		Source:         corev1.EventSource{Component: "prom-rules-manager"},
+		FirstTimestamp: now,
+		LastTimestamp:  now,
+		Count:          1,
+	}, metav1.CreateOptions{})
+	if err != nil {
+		level.Warn(d.logger).Log("msg", "Unable to emit drift event", "err", err)
+	}
+}
+
+// parseSnapshot returns the rule groups of a rule file, none if it cannot be
+// parsed.
+func parseSnapshot(content string) []SimpleRuleGroup {
+	rgs, _ := Parse([]byte(content))
+	if rgs == nil {
+		return nil
+	}
+	return snapshot(rgs)
+}
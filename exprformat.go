@@ -0,0 +1,162 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/alecthomas/kingpin"
+	"github.com/prometheus/common/route"
+	"github.com/prometheus/prometheus/promql/parser"
+	"golang.org/x/exp/slices"
+)
+
+var formatExpressions = kingpin.Flag("rules.format-expressions", "Rewrite the expressions of written rules with the PromQL pretty printer. The submitted expressions are kept along with the rules.").Default("false").Bool()
+
+// originalsAnnotation stores the submitted expressions of the written rules
+// whose expressions were formatted, as a JSON object mapping group names to
+// SubmittedExprs.
+const originalsAnnotation = annotationPrefix + "original-exprs"
+
+// SubmittedExpr is the expression a rule was submitted with before it was
+// formatted.
+type SubmittedExpr struct {
+	Rule string `json:"rule"`
+	Expr string `json:"expr"`
+}
+
+// canonicalExpr returns expr as formatted by the PromQL pretty printer, or
+// expr itself if it cannot be parsed.
+func canonicalExpr(expr string) string {
+	e, err := parser.ParseExpr(expr)
+	if err != nil {
+		return expr
+	}
+	return parser.Prettify(e)
+}
+
+// sameExpr reports whether a and b parse to the same expression, ignoring
+// whitespace and formatting.
+func sameExpr(a, b string) bool {
+	if a == b {
+		return true
+	}
+	ea, err := parser.ParseExpr(a)
+	if err != nil {
+		return false
+	}
+	eb, err := parser.ParseExpr(b)
+	if err != nil {
+		return false
+	}
+	return ea.String() == eb.String()
+}
+
+// originalKey identifies a written rule whose submitted expression was
+// rewritten.
+func originalKey(group, name, expr string) string {
+	return group + "\x00" + name + "\x00" + expr
+}
+
+// canonicalize returns the canonical form of the expression of the named
+// rule and remembers the submitted one for the change.
+func (manager *RulesManager) canonicalize(group, name, expr string) string {
+	formatted := canonicalExpr(expr)
+	if formatted != expr {
+		if manager.originals == nil {
+			manager.originals = map[string]string{}
+		}
+		manager.originals[originalKey(group, name, formatted)] = expr
+	}
+	return formatted
+}
+
+// canonicalizeGroup formats the expressions of group, if enabled.
+func (manager *RulesManager) canonicalizeGroup(group SimpleRuleGroup) SimpleRuleGroup {
+	if !*formatExpressions {
+		return group
+	}
+	group.Rules = slices.Clone(group.Rules)
+	for i, r := range group.Rules {
+		group.Rules[i].Expr = manager.canonicalize(group.Name, ruleName(r), r.Expr)
+	}
+	return group
+}
+
+// canonicalizeGroups formats the expressions of groups, if enabled. The
+// groups passed in are left untouched.
+func (manager *RulesManager) canonicalizeGroups(groups []RuleGroup) []RuleGroup {
+	if !*formatExpressions {
+		return groups
+	}
+	formatted := make([]RuleGroup, len(groups))
+	for i, g := range groups {
+		g.Rules = slices.Clone(g.Rules)
+		for j, r := range g.Rules {
+			g.Rules[j].Expr.SetString(manager.canonicalize(g.Name, r.Alert.Value+r.Record.Value, r.Expr.Value))
+		}
+		formatted[i] = g
+	}
+	return formatted
+}
+
+// submittedExprs returns the stored submitted expressions by group.
+func (manager *RulesManager) submittedExprs() map[string][]SubmittedExpr {
+	submitted := map[string][]SubmittedExpr{}
+	if v, ok := manager.annotations[originalsAnnotation]; ok {
+		// A corrupted annotation only loses the submitted expressions.
+		json.Unmarshal([]byte(v), &submitted)
+	}
+	return submitted
+}
+
+// storeSubmittedExprs stores the submitted expressions of the rules rewritten
+// by the current update along with the ones stored before. Expressions of
+// rules which were removed or changed since are dropped.
+func (manager *RulesManager) storeSubmittedExprs() {
+	stored := manager.submittedExprs()
+	submitted := map[string][]SubmittedExpr{}
+	for _, g := range manager.ruleGroups.Groups {
+		for _, r := range g.Rules {
+			name, expr := r.Alert.Value+r.Record.Value, r.Expr.Value
+			original, ok := manager.originals[originalKey(g.Name, name, expr)]
+			for _, s := range stored[g.Name] {
+				if !ok && s.Rule == name && canonicalExpr(s.Expr) == expr {
+					original, ok = s.Expr, true
+				}
+			}
+			if ok {
+				submitted[g.Name] = append(submitted[g.Name], SubmittedExpr{Rule: name, Expr: original})
+			}
+		}
+	}
+	if len(submitted) == 0 {
+		delete(manager.annotations, originalsAnnotation)
+		return
+	}
+	b, _ := json.Marshal(submitted)
+	manager.annotations[originalsAnnotation] = string(b)
+}
+
+// submittedGroupExprs lists the submitted expressions of the formatted rules
+// of a group.
+func (h *Handler) submittedGroupExprs(w http.ResponseWriter, r *http.Request) {
+	name := route.Param(r.Context(), "group")
+	rulesManager, err := NewCachedRulesManager()
+	if err != nil {
+		h.writeError(w, "Rules cannot be read", err)
+		return
+	}
+	for _, g := range rulesManager.ruleGroups.Groups {
+		if g.Name == name {
+			submitted := rulesManager.submittedExprs()[name]
+			if submitted == nil {
+				submitted = []SubmittedExpr{}
+			}
+			writeJSON(w, http.StatusOK, submitted)
+			return
+		}
+	}
+	w.WriteHeader(http.StatusNotFound)
+	fmt.Fprintf(w, "Group %q does not exist.\n", name)
+}
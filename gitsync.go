@@ -0,0 +1,445 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/alecthomas/kingpin"
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"gopkg.in/yaml.v3"
+)
+
+// gitSyncActor is the actor of the changes made by syncing from Git.
+const gitSyncActor = "git-sync"
+
+// errChangesPending defers a sync while changes made through the API are not
+// committed into the repository yet, applying it would revert them.
+var errChangesPending = errors.New("changes are pending commit")
+
+var (
+	gitRepository   = kingpin.Flag("git.repository", "Git repository to sync rule files from, either a local working tree such as a git-sync volume or a file:// URL which is cloned. Git sync is disabled if empty.").Default("").String()
+	gitCheckoutDir  = kingpin.Flag("git.checkout-dir", "Directory a git.repository URL is cloned into.").Default("data/git").String()
+	gitRulesPath    = kingpin.Flag("git.path", "Directory holding the rule files within the repository.").Default(".").String()
+	gitSyncInterval = kingpin.Flag("git.interval", "Interval between syncs from the repository.").Default("1m").Duration()
+	gitSource       = kingpin.Flag("git.source", "Source the groups applied from the repository are owned by.").Default("git").String()
+	gitCommit       = kingpin.Flag("git.commit-changes", "Commit changes made through the API back into the repository, and push them if it has a remote. The repository then owns all groups.").Default("false").Bool()
+)
+
+// GitSyncStatus describes the last sync from the repository.
+type GitSyncStatus struct {
+	Repository  string     `json:"repository"`
+	Commit      string     `json:"commit"`
+	LastSync    time.Time  `json:"lastSync"`
+	LastSuccess time.Time  `json:"lastSuccess"`
+	Error       string     `json:"error,omitempty"`
+	Plan        *ApplyPlan `json:"plan,omitempty"`
+	// CommitError is the error of the last failed commit of a change back
+	// into the repository, cleared by the next successful one. The failed
+	// change is reverted by the next sync.
+	CommitError string `json:"commitError,omitempty"`
+}
+
+// GitSync reconciles the rule files of a Git repository into the ConfigMap
+// and optionally commits changes made through the API back.
+type GitSync struct {
+	logger        log.Logger
+	queue         *WriteQueue
+	repository    string
+	dir           string
+	path          string
+	interval      time.Duration
+	source        string
+	commitChanges bool
+
+	// pending holds the changes to commit back, notify is signaled when one
+	// is added.
+	pendingMtx sync.Mutex
+	pending    []Change
+	notify     chan struct{}
+
+	// mtx serializes the use of the working tree.
+	mtx    sync.Mutex
+	status GitSyncStatus
+	// deferred is set while a sync waits for the pending changes to be
+	// committed.
+	deferred bool
+}
+
+// NewGitSync returns a GitSync for the configured repository, writing through
+// queue.
+func NewGitSync(logger log.Logger, queue *WriteQueue) *GitSync {
+	g := &GitSync{
+		logger:        logger,
+		queue:         queue,
+		repository:    *gitRepository,
+		dir:           *gitRepository,
+		path:          *gitRulesPath,
+		interval:      *gitSyncInterval,
+		source:        *gitSource,
+		commitChanges: *gitCommit,
+		notify:        make(chan struct{}, 1),
+		status:        GitSyncStatus{Repository: *gitRepository},
+	}
+	if g.isURL() {
+		g.dir = *gitCheckoutDir
+	}
+	if g.commitChanges {
+		onChange(func(c Change) {
+			if c.Actor == gitSyncActor {
+				return
+			}
+			g.pendingMtx.Lock()
+			g.pending = append(g.pending, c)
+			g.pendingMtx.Unlock()
+			select {
+			case g.notify <- struct{}{}:
+			default:
+			}
+		})
+	}
+	return g
+}
+
+// Run syncs from the repository every interval and commits changes back until
+// ctx is canceled.
+func (g *GitSync) Run(ctx context.Context) error {
+	ticker := time.NewTicker(g.interval)
+	defer ticker.Stop()
+
+	g.sync(ctx)
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+			g.sync(ctx)
+		case <-g.notify:
+			g.mtx.Lock()
+			g.commitPending(ctx)
+			deferred := g.deferred
+			g.mtx.Unlock()
+			if deferred {
+				g.sync(ctx)
+			}
+		}
+	}
+}
+
+// Status returns the status of the last sync.
+func (g *GitSync) Status() GitSyncStatus {
+	g.mtx.Lock()
+	defer g.mtx.Unlock()
+	return g.status
+}
+
+// sync applies the rule files of the repository. The changes made through
+// the API which are not committed yet are committed first. The repository is
+// read before the write is queued, not to hold up the other writes, so the
+// sync is deferred if changes were made in between.
+func (g *GitSync) sync(ctx context.Context) {
+	start := time.Now()
+	plan := &ApplyPlan{Source: g.source}
+	g.mtx.Lock()
+	g.commitPending(ctx)
+	groups, err := g.reconcile(ctx)
+	g.mtx.Unlock()
+	if err == nil {
+		err = g.queue.Submit(ctx, gitSyncActor, writeOp{
+			description: fmt.Sprintf("Sync from Git repository %s", g.repository),
+			exclusive:   true,
+			mutate: func(manager *RulesManager) error {
+				// Changes are notified as they are written, so the ones
+				// written before this write are all pending by now.
+				if g.hasPending() {
+					return errChangesPending
+				}
+				// When changes are committed back, the repository holds all
+				// groups.
+				return applyOp(g.source, groups, g.commitChanges, plan).mutate(manager)
+			},
+		})
+	}
+	plan.Applied = err == nil
+
+	g.mtx.Lock()
+	defer g.mtx.Unlock()
+	g.deferred = errors.Is(err, errChangesPending)
+	if g.deferred {
+		level.Debug(g.logger).Log("msg", "Git sync deferred until the pending changes are committed")
+		return
+	}
+	g.status.LastSync = start
+	g.status.Plan = plan
+	if err != nil {
+		level.Error(g.logger).Log("msg", "Git sync failed", "err", err)
+		g.status.Error = err.Error()
+		gitSyncFailures.Inc()
+		return
+	}
+	g.status.Error = ""
+	g.status.LastSuccess = g.status.LastSync
+	gitSyncLastSuccess.Set(float64(g.status.LastSuccess.Unix()))
+}
+
+// reconcile pulls the repository and reads its rule files.
+func (g *GitSync) reconcile(ctx context.Context) ([]RuleGroup, error) {
+	if err := g.pull(ctx); err != nil {
+		return nil, err
+	}
+	commit, err := g.git(ctx, "rev-parse", "HEAD")
+	if err != nil {
+		return nil, err
+	}
+	if commit != g.status.Commit {
+		gitSyncCommit.Reset()
+		gitSyncCommit.WithLabelValues(commit).Set(1)
+	}
+	g.status.Commit = commit
+
+	groups, _, errs := g.readRules()
+	if len(errs) > 0 {
+		validationFailures.WithLabelValues(validationParse).Inc()
+		return nil, fmt.Errorf("rule files have errors: %v", errs)
+	}
+	return groups, nil
+}
+
+// pull updates the working tree. Local working trees are left to whatever
+// updates them, e.g. git-sync.
+func (g *GitSync) pull(ctx context.Context) error {
+	if !g.isURL() {
+		return nil
+	}
+	if _, err := os.Stat(filepath.Join(g.dir, ".git")); os.IsNotExist(err) {
+		if err := os.MkdirAll(filepath.Dir(g.dir), 0o755); err != nil {
+			return err
+		}
+		_, err := g.run(ctx, "", "clone", "--quiet", g.repository, g.dir)
+		return err
+	}
+	_, err := g.git(ctx, "pull", "--quiet", "--ff-only")
+	return err
+}
+
+// readRules parses the rule files of the repository. It also returns the
+// file each group is read from.
+func (g *GitSync) readRules() ([]RuleGroup, map[string]string, []error) {
+	var (
+		groups []RuleGroup
+		files  = map[string]string{}
+		errs   []error
+	)
+	var matches []string
+	for _, pattern := range []string{"*.yml", "*.yaml"} {
+		m, err := filepath.Glob(filepath.Join(g.dir, g.path, pattern))
+		if err != nil {
+			return nil, nil, []error{err}
+		}
+		matches = append(matches, m...)
+	}
+	sort.Strings(matches)
+
+	for _, file := range matches {
+		rgs, fileErrs := ParseFile(file)
+		if len(fileErrs) > 0 {
+			errs = append(errs, fileErrs...)
+			continue
+		}
+		for _, rg := range rgs.Groups {
+			if other, ok := files[rg.Name]; ok {
+				errs = append(errs, fmt.Errorf("%s: groupname: %q is repeated in %s", file, rg.Name, other))
+				continue
+			}
+			files[rg.Name] = file
+			groups = append(groups, rg)
+		}
+	}
+	return groups, files, errs
+}
+
+// hasPending returns whether changes are pending commit.
+func (g *GitSync) hasPending() bool {
+	g.pendingMtx.Lock()
+	defer g.pendingMtx.Unlock()
+	return len(g.pending) > 0
+}
+
+// commitPending commits the pending changes back into the repository. The
+// caller must hold mtx.
+func (g *GitSync) commitPending(ctx context.Context) {
+	for {
+		g.pendingMtx.Lock()
+		if len(g.pending) == 0 {
+			g.pendingMtx.Unlock()
+			return
+		}
+		c := g.pending[0]
+		g.pendingMtx.Unlock()
+
+		g.commitChange(ctx, c)
+
+		g.pendingMtx.Lock()
+		g.pending = g.pending[1:]
+		g.pendingMtx.Unlock()
+	}
+}
+
+// commitChange commits c back into the repository and records the result in
+// the status. On failure the working tree is reset to the upstream branch, not
+// to block the later pulls.
+func (g *GitSync) commitChange(ctx context.Context, c Change) {
+	if err := g.writeChange(ctx, c); err != nil {
+		level.Error(g.logger).Log("msg", "Committing change failed", "change", c.Description, "err", err)
+		g.status.CommitError = fmt.Sprintf("%s: %s", c.Description, err)
+		gitSyncFailures.Inc()
+		if err := g.reset(ctx); err != nil {
+			level.Error(g.logger).Log("msg", "Resetting the working tree failed", "err", err)
+		}
+		return
+	}
+	g.status.CommitError = ""
+}
+
+// reset discards the local changes and commits of the working tree.
+func (g *GitSync) reset(ctx context.Context) error {
+	target := "HEAD"
+	if _, err := g.git(ctx, "rev-parse", "--verify", "--quiet", "@{u}"); err == nil {
+		target = "@{u}"
+	}
+	if _, err := g.git(ctx, "reset", "--hard", "--quiet", target); err != nil {
+		return err
+	}
+	_, err := g.git(ctx, "clean", "--force", "--quiet", "--", g.path)
+	return err
+}
+
+// writeChange writes the rule groups after c into the repository, commits and
+// pushes them. Groups are written back to the file they were read from, new
+// groups get a file of their own.
+func (g *GitSync) writeChange(ctx context.Context, c Change) error {
+	if err := g.pull(ctx); err != nil {
+		return err
+	}
+	_, files, errs := g.readRules()
+	if len(errs) > 0 {
+		return fmt.Errorf("rule files have errors: %v", errs)
+	}
+
+	added, updated, removed := diffGroups(c.Before, c.After)
+	changed := map[string]struct{}{}
+	for _, group := range append(append(added, updated...), removed...) {
+		changed[group] = struct{}{}
+	}
+
+	// Only files holding changed groups are rewritten.
+	contents := map[string]*RuleGroups{}
+	dirty := map[string]struct{}{}
+	for group, file := range files {
+		contents[file] = &RuleGroups{Groups: []RuleGroup{}}
+		if _, ok := changed[group]; ok {
+			dirty[file] = struct{}{}
+		}
+	}
+	for _, group := range c.After {
+		file, ok := files[group.Name]
+		if !ok {
+			file = filepath.Join(g.dir, g.path, invalidFileNameChars.ReplaceAllString(group.Name, "_")+".yml")
+			if contents[file] == nil {
+				contents[file] = &RuleGroups{Groups: []RuleGroup{}}
+			}
+		}
+		if _, ok := changed[group.Name]; ok {
+			dirty[file] = struct{}{}
+		}
+		contents[file].Groups = append(contents[file].Groups, newRuleGroupNode(group))
+	}
+	for file, rgs := range contents {
+		if _, ok := dirty[file]; !ok {
+			continue
+		}
+		if len(rgs.Groups) == 0 {
+			if err := os.Remove(file); err != nil {
+				return err
+			}
+			continue
+		}
+		b, err := yaml.Marshal(rgs)
+		if err != nil {
+			return err
+		}
+		if err := os.WriteFile(file, b, 0o644); err != nil {
+			return err
+		}
+	}
+
+	if _, err := g.git(ctx, "add", "--all", "--", g.path); err != nil {
+		return err
+	}
+	if _, err := g.git(ctx, "diff", "--cached", "--quiet"); err == nil {
+		// Nothing changed, e.g. only the formatting differs.
+		return nil
+	}
+	_, err := g.git(ctx,
+		"-c", "user.name=prom-rules-manager",
+		"-c", "user.email=prom-rules-manager@localhost",
+		"commit", "--quiet", "-m", commitMessage(c),
+	)
+	if err != nil {
+		return err
+	}
+	remotes, err := g.git(ctx, "remote")
+	if err != nil || remotes == "" {
+		return err
+	}
+	_, err = g.git(ctx, "push", "--quiet")
+	return err
+}
+
+// commitMessage describes c for a commit.
+func commitMessage(c Change) string {
+	var b strings.Builder
+	b.WriteString(c.Description)
+	b.WriteString("\n\n")
+	added, updated, removed := diffGroups(c.Before, c.After)
+	for _, d := range []struct {
+		verb   string
+		groups []string
+	}{{"Added", added}, {"Updated", updated}, {"Removed", removed}} {
+		if len(d.groups) > 0 {
+			fmt.Fprintf(&b, "%s groups: %s\n", d.verb, strings.Join(d.groups, ", "))
+		}
+	}
+	fmt.Fprintf(&b, "\nChanged-by: %s\n", c.Actor)
+	return b.String()
+}
+
+func (g *GitSync) isURL() bool {
+	return strings.Contains(g.repository, "://")
+}
+
+// git runs a git command in the working tree.
+func (g *GitSync) git(ctx context.Context, args ...string) (string, error) {
+	return g.run(ctx, g.dir, args...)
+}
+
+func (g *GitSync) run(ctx context.Context, dir string, args ...string) (string, error) {
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, "git", args...)
+	cmd.Dir = dir
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("git %s: %w: %s", args[0], err, strings.TrimSpace(stderr.String()))
+	}
+	return strings.TrimSpace(stdout.String()), nil
+}
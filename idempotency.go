@@ -0,0 +1,334 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/alecthomas/kingpin"
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/util/retry"
+)
+
+const (
+	// idempotencyKey is the key of the ConfigMap idempotencyConfigMap holding
+	// the persisted responses, as a JSON object mapping keys to responses.
+	idempotencyKey = "responses.json"
+	// maxPersistedBytes bounds the size of the persisted responses, the ones
+	// expiring first are dropped.
+	maxPersistedBytes = 256 << 10
+)
+
+// idempotencyConfigMap is the ConfigMap the responses are persisted in, apart
+// from the rules so that it cannot make rule writes fail.
+var idempotencyConfigMap = rulefileConfigMap + "-idempotency"
+
+var (
+	idempotencyTTL     = kingpin.Flag("idempotency.ttl", "Time the responses to requests with an Idempotency-Key are replayed for. 0 disables idempotency keys.").Default("24h").Duration()
+	idempotencyPersist = kingpin.Flag("idempotency.persist", "Persist the status of the responses to requests with an Idempotency-Key in a ConfigMap next to the rules ConfigMap, so that all replicas replay them.").Default("false").Bool()
+)
+
+// errKeyInProgress is returned while a request with the same Idempotency-Key
+// is being served.
+var errKeyInProgress = errors.New("a request with the same Idempotency-Key is in progress")
+
+// idempotentResponse is the response to a request with an Idempotency-Key.
+type idempotentResponse struct {
+	// Fingerprint identifies the request, a key must not be reused with a
+	// different request.
+	Fingerprint string `json:"fingerprint"`
+	Status      int    `json:"status"`
+	ContentType string `json:"-"`
+	// Body is only kept in memory, BodyHash is persisted instead.
+	Body     []byte    `json:"-"`
+	BodyHash string    `json:"bodyHash"`
+	Expires  time.Time `json:"expires"`
+}
+
+// IdempotencyStore remembers the responses to requests with an
+// Idempotency-Key, so that retries replay them instead of writing again.
+type IdempotencyStore struct {
+	logger  log.Logger
+	ttl     time.Duration
+	persist bool
+
+	mtx        sync.Mutex
+	responses  map[string]*idempotentResponse
+	inProgress map[string]struct{}
+	// persistMtx serializes the writes of the persisted responses.
+	persistMtx sync.Mutex
+}
+
+// NewIdempotencyStore returns an IdempotencyStore persisting responses if
+// configured.
+func NewIdempotencyStore(logger log.Logger) *IdempotencyStore {
+	return &IdempotencyStore{
+		logger:     logger,
+		ttl:        *idempotencyTTL,
+		persist:    *idempotencyPersist,
+		responses:  map[string]*idempotentResponse{},
+		inProgress: map[string]struct{}{},
+	}
+}
+
+// begin returns the response stored for key, if any. Otherwise key is marked
+// in progress until finish is called.
+func (s *IdempotencyStore) begin(key string) (*idempotentResponse, error) {
+	if resp, found, err := s.lookup(key, nil, !s.persist); found {
+		return resp, err
+	}
+	// Read outside of the lock, not to hold up the other requests.
+	resp, _, err := s.lookup(key, s.persisted(key), true)
+	return resp, err
+}
+
+// lookup returns the response stored in memory for key, or persisted if not
+// nil. Without a response, key is marked in progress if mark is set and found
+// is false otherwise.
+func (s *IdempotencyStore) lookup(key string, persisted *idempotentResponse, mark bool) (resp *idempotentResponse, found bool, err error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if _, ok := s.inProgress[key]; ok {
+		return nil, true, errKeyInProgress
+	}
+	if resp, ok := s.responses[key]; ok && time.Now().Before(resp.Expires) {
+		return resp, true, nil
+	}
+	if persisted != nil {
+		s.responses[key] = persisted
+		return persisted, true, nil
+	}
+	if !mark {
+		return nil, false, nil
+	}
+	s.inProgress[key] = struct{}{}
+	return nil, true, nil
+}
+
+// finish stores the response for key. Failures which may succeed on retry
+// are not stored. The response is persisted in the background, a failure to
+// persist it only loses it for the other replicas.
+func (s *IdempotencyStore) finish(key string, resp *idempotentResponse) {
+	store := resp.Status < http.StatusInternalServerError && resp.Status != http.StatusTooManyRequests
+	s.mtx.Lock()
+	delete(s.inProgress, key)
+	if store {
+		now := time.Now()
+		for k, r := range s.responses {
+			if now.After(r.Expires) {
+				delete(s.responses, k)
+			}
+		}
+		resp.Expires = now.Add(s.ttl)
+		resp.BodyHash = checksum(string(resp.Body))
+		s.responses[key] = resp
+	}
+	s.mtx.Unlock()
+
+	if store && s.persist {
+		go func() {
+			if err := s.persistResponse(key, resp); err != nil {
+				level.Warn(s.logger).Log("msg", "Unable to persist the response to an idempotent request", "err", err)
+			}
+		}()
+	}
+}
+
+// persisted returns the response to key persisted by any replica.
+func (s *IdempotencyStore) persisted(key string) *idempotentResponse {
+	responses, _, err := loadPersistedResponses()
+	if err != nil {
+		level.Warn(s.logger).Log("msg", "Unable to read the persisted responses to idempotent requests", "err", err)
+		return nil
+	}
+	resp, ok := responses[key]
+	if !ok || time.Now().After(resp.Expires) {
+		return nil
+	}
+	return resp
+}
+
+// loadPersistedResponses returns the persisted responses and the ConfigMap
+// holding them, nil if it does not exist yet.
+func loadPersistedResponses() (map[string]*idempotentResponse, *corev1.ConfigMap, error) {
+	clientset, err := getClientset()
+	if err != nil {
+		return nil, nil, err
+	}
+	responses := map[string]*idempotentResponse{}
+	cm, err := clientset.CoreV1().ConfigMaps(namespace).Get(context.TODO(), idempotencyConfigMap, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return responses, nil, nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	// A corrupted ConfigMap only loses the responses.
+	json.Unmarshal([]byte(cm.Data[idempotencyKey]), &responses)
+	return responses, cm, nil
+}
+
+// persistResponse stores the response to key, dropping expired responses and
+// the ones expiring first beyond maxPersistedBytes.
+func (s *IdempotencyStore) persistResponse(key string, resp *idempotentResponse) error {
+	s.persistMtx.Lock()
+	defer s.persistMtx.Unlock()
+	clientset, err := getClientset()
+	if err != nil {
+		return err
+	}
+	retriable := func(err error) bool {
+		return apierrors.IsConflict(err) || apierrors.IsAlreadyExists(err)
+	}
+	return retry.OnError(retry.DefaultRetry, retriable, func() error {
+		responses, cm, err := loadPersistedResponses()
+		if err != nil {
+			return err
+		}
+		responses[key] = resp
+		data, err := encodePersistedResponses(responses, time.Now())
+		if err != nil {
+			return err
+		}
+		if cm == nil {
+			cm = &corev1.ConfigMap{
+				ObjectMeta: metav1.ObjectMeta{Name: idempotencyConfigMap, Namespace: namespace},
+				Data:       map[string]string{idempotencyKey: data},
+			}
+			_, err = clientset.CoreV1().ConfigMaps(namespace).Create(context.TODO(), cm, metav1.CreateOptions{})
+			return err
+		}
+		if cm.Data == nil {
+			cm.Data = map[string]string{}
+		}
+		cm.Data[idempotencyKey] = data
+		_, err = clientset.CoreV1().ConfigMaps(namespace).Update(context.TODO(), cm, metav1.UpdateOptions{})
+		return err
+	})
+}
+
+// encodePersistedResponses encodes the responses not expired at now, dropping
+// the ones expiring first until they fit in maxPersistedBytes.
+func encodePersistedResponses(responses map[string]*idempotentResponse, now time.Time) (string, error) {
+	keys := make([]string, 0, len(responses))
+	for k, r := range responses {
+		if now.After(r.Expires) {
+			delete(responses, k)
+			continue
+		}
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return responses[keys[i]].Expires.After(responses[keys[j]].Expires)
+	})
+	for {
+		b, err := json.Marshal(responses)
+		if err != nil || len(b) <= maxPersistedBytes || len(keys) == 0 {
+			return string(b), err
+		}
+		delete(responses, keys[len(keys)-1])
+		keys = keys[:len(keys)-1]
+	}
+}
+
+// responseRecorder records the response passing through it.
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (r *responseRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *responseRecorder) Write(b []byte) (int, error) {
+	r.body.Write(b)
+	return r.ResponseWriter.Write(b)
+}
+
+// idempotent replays the stored response to requests repeating the
+// Idempotency-Key of an earlier request instead of serving them again.
+func (h *Handler) idempotent(f http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get("Idempotency-Key")
+		store := h.options.Idempotency
+		if key == "" || store == nil {
+			f(w, r)
+			return
+		}
+
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxImportSize))
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			w.WriteHeader(http.StatusRequestEntityTooLarge)
+			fmt.Fprintf(w, "Request body exceeds the limit of %d bytes.\n", maxImportSize)
+			return
+		}
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, "Request body cannot be read.\n")
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		fingerprint := checksum(r.Method + " " + r.URL.RequestURI() + "\n" + string(body))
+
+		// Keys are scoped by actor, so that clients cannot replay each other's
+		// responses.
+		scoped := checksum(requestActor(r) + "\x00" + key)
+		resp, err := store.begin(scoped)
+		if err != nil {
+			w.WriteHeader(http.StatusConflict)
+			fmt.Fprintf(w, "%s, retry later.\n", err)
+			return
+		}
+		if resp != nil {
+			if resp.Fingerprint != fingerprint {
+				w.WriteHeader(http.StatusUnprocessableEntity)
+				fmt.Fprintf(w, "Idempotency-Key %q is already used by a different request.\n", key)
+				return
+			}
+			level.Info(h.logger).Log("msg", "Replaying response to idempotent request", "key", key)
+			if resp.ContentType != "" {
+				w.Header().Set("Content-Type", resp.ContentType)
+			}
+			w.Header().Set("Idempotent-Replayed", "true")
+			w.WriteHeader(resp.Status)
+			if resp.Body == nil {
+				// Persisted by another replica, which keeps only the status.
+				fmt.Fprintf(w, "Request was already served with status %d.\n", resp.Status)
+				return
+			}
+			w.Write(resp.Body)
+			return
+		}
+
+		rec := &responseRecorder{ResponseWriter: w, status: http.StatusOK}
+		defer func() {
+			if err := recover(); err != nil {
+				// Release the key, the request may be retried.
+				store.finish(scoped, &idempotentResponse{Status: http.StatusInternalServerError})
+				panic(err)
+			}
+		}()
+		f(rec, r)
+		store.finish(scoped, &idempotentResponse{
+			Fingerprint: fingerprint,
+			Status:      rec.status,
+			ContentType: w.Header().Get("Content-Type"),
+			Body:        rec.body.Bytes(),
+		})
+	}
+}
@@ -3,17 +3,25 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"os"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/alecthomas/kingpin"
+	"github.com/go-kit/log/level"
 	"golang.org/x/exp/slices"
-	"gopkg.in/yaml.v3"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
 	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/clientcmd"
+	"k8s.io/client-go/util/retry"
 )
 
 const (
@@ -23,105 +31,405 @@ const (
 )
 
 var (
-	clientset *kubernetes.Clientset
+	configMapCreate      = kingpin.Flag("configmap.create", "Create the rules ConfigMap at startup if it does not exist.").Default("false").Bool()
+	configMapLabels      = kingpin.Flag("configmap.label", "Label set on the rules ConfigMap when it is created, as name=value. May be repeated.").StringMap()
+	configMapAnnotations = kingpin.Flag("configmap.annotation", "Annotation set on the rules ConfigMap when it is created, as name=value. May be repeated.").StringMap()
+	configMapOwner       = kingpin.Flag("configmap.owner", "Object in the same namespace set as owner of the rules ConfigMap when it is created, as <apiVersion>/<kind>/<name>.").Default("").String()
 )
 
-func init() {
-	kingpin.Parse()
-	// Get the clientset
-	var err error
+var (
+	clientsetMtx sync.Mutex
+	clientset    *kubernetes.Clientset
+)
+
+// errNoClientset is returned when no Kubernetes client can be built, e.g.
+// because the cluster configuration is not available yet.
+var errNoClientset = errors.New("no Kubernetes client available")
+
+// getClientset returns the Kubernetes clientset. It is built on first use and
+// building it is retried on every call until it succeeds.
+func getClientset() (*kubernetes.Clientset, error) {
+	clientsetMtx.Lock()
+	defer clientsetMtx.Unlock()
+
+	if clientset != nil {
+		return clientset, nil
+	}
+	var (
+		cs  *kubernetes.Clientset
+		err error
+	)
 	if *standaloneMode {
-		clientset, err = getOutOfClusterClient()
+		cs, err = getOutOfClusterClient()
 	} else {
-		clientset, err = getInClusterClient()
+		cs, err = getInClusterClient()
 	}
 	if err != nil {
-		panic(fmt.Sprintf("Failed to get clientset: %v\n", err))
+		return nil, fmt.Errorf("%w: %v", errNoClientset, err)
 	}
+	clientset = cs
+	return clientset, nil
 }
 
 type RulesManager struct {
 	ruleGroups *RuleGroups
+	// shards are the ConfigMaps the rule groups are spread over.
+	shards []*shard
+	// groupShards maps group names to the index of the shard holding them.
+	groupShards map[string]int
+	// parseErrors holds the errors of parsing the rule file on the last load.
+	parseErrors []error
+	// annotations holds the annotations with annotationPrefix stored on the
+	// first shard, to be written back along with the rule groups.
+	annotations map[string]string
+	// actor is who the changes are made by.
+	actor string
+	// cached is set if the rule groups are read from the informer cache. Such
+	// a manager may be stale and is only used for reads.
+	cached bool
+	// originals holds the submitted expressions of the rules rewritten by
+	// the current update, by originalKey.
+	originals map[string]string
+}
+
+// annotationPrefix prefixes the annotations the manager keeps state in.
+const annotationPrefix = "prom-rules-manager/"
+
+func NewRulesManager() (*RulesManager, error) {
+	manager := &RulesManager{}
+	if err := manager.load(); err != nil {
+		return nil, err
+	}
+	return manager, nil
+}
+
+// NewCachedRulesManager reads the rule groups from the informer cache if
+// there is one. The rule groups may be stale, writes must use
+// NewRulesManager.
+func NewCachedRulesManager() (*RulesManager, error) {
+	manager := &RulesManager{cached: true}
+	if err := manager.load(); err != nil {
+		return nil, err
+	}
+	return manager, nil
+}
+
+// load reads and parses the rule files from the ConfigMaps and merges them
+// into a single set of rule groups.
+func (manager *RulesManager) load() error {
+	clientset, err := getClientset()
+	if err != nil {
+		return err
+	}
+
+	manager.shards = newShards()
+	manager.groupShards = map[string]int{}
+	manager.ruleGroups = &RuleGroups{Groups: []RuleGroup{}}
+	manager.parseErrors = nil
+	manager.annotations = map[string]string{}
+	size := 0
+	for i, s := range manager.shards {
+		if err := manager.loadShard(clientset, i, s); err != nil {
+			return err
+		}
+		size += len(s.content)
+	}
+
+	// Groups left on the ConfigMaps of another shard count are moved to the
+	// configured shards on the next write.
+	if *configMapShards > 0 {
+		if _, err := manager.loadRetired(clientset, unshardedShard()); err != nil {
+			return err
+		}
+	}
+	first := *configMapShards
+	if first < 0 {
+		first = 0
+	}
+	for i := first; ; i++ {
+		found, err := manager.loadRetired(clientset, numberedShard(i))
+		if err != nil {
+			return err
+		}
+		if !found {
+			break
+		}
+	}
+	updateRuleMetrics(manager.ruleGroups, size)
+	return nil
+}
+
+// loadShard reads and parses the rule file of the i-th shard.
+func (manager *RulesManager) loadShard(clientset *kubernetes.Clientset, i int, s *shard) error {
+	var (
+		rulesConfig *corev1.ConfigMap
+		err         error
+		start       = time.Now()
+	)
+	if manager.cached {
+		rulesConfig, err = getCachedConfigMap(context.TODO(), s.configMap)
+	} else {
+		// specify namespace to get cm in particular namespace
+		rulesConfig, err = clientset.CoreV1().ConfigMaps(namespace).Get(context.TODO(), s.configMap, metav1.GetOptions{})
+		observeConfigMap("read", start, err)
+	}
+	if apierrors.IsNotFound(err) {
+		// The ConfigMap is created on the first write.
+		s.missing = true
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	s.resourceVersion = rulesConfig.ResourceVersion
+	s.content = rulesConfig.Data[s.key]
+	s.annotations = rulesConfig.Annotations
+	if i == 0 || s.retired {
+		for k, v := range rulesConfig.Annotations {
+			if _, ok := manager.annotations[k]; !ok && strings.HasPrefix(k, annotationPrefix) && k != checksumAnnotation {
+				manager.annotations[k] = v
+			}
+		}
+	}
+
+	ruleGroups, errs := Parse([]byte(s.content))
+	if len(manager.shards) > 1 {
+		for j := range errs {
+			errs[j] = fmt.Errorf("%s: %w", s.key, errs[j])
+		}
+	}
+	if ruleGroups == nil {
+		return fmt.Errorf("cannot parse %s in ConfigMap %s/%s: %v", s.key, namespace, s.configMap, errs)
+	}
+	manager.parseErrors = append(manager.parseErrors, errs...)
+	for _, g := range ruleGroups.Groups {
+		if _, ok := manager.groupShards[g.Name]; ok {
+			// Left behind by an interrupted move between shards, it
+			// is dropped from this shard on the next write.
+			continue
+		}
+		manager.groupShards[g.Name] = i
+		manager.ruleGroups.Groups = append(manager.ruleGroups.Groups, g)
+	}
+	return nil
 }
 
-func NewRulesManager() *RulesManager {
-	// specify namespace to get cm in particular namespace
-	rulesConfig, err := clientset.CoreV1().ConfigMaps(namespace).Get(context.TODO(), rulefileConfigMap, metav1.GetOptions{})
+// loadRetired reads the groups and the manager's state left on a ConfigMap
+// which is not among the configured shards, if it exists.
+func (manager *RulesManager) loadRetired(clientset *kubernetes.Clientset, s *shard) (bool, error) {
+	s.retired = true
+	if err := manager.loadShard(clientset, len(manager.shards), s); err != nil || s.missing {
+		return false, err
+	}
+	manager.shards = append(manager.shards, s)
+	groups := 0
+	for _, i := range manager.groupShards {
+		if i == len(manager.shards)-1 {
+			groups++
+		}
+	}
+	if groups > 0 {
+		level.Warn(logger).Log("msg", "ConfigMap is not among the configured shards, its groups are moved on the next write", "configmap", s.configMap, "groups", groups)
+	}
+	return true, nil
+}
 
+// checkRuleFile reports whether the ConfigMap can be read and the rule file in
+// it parses without errors. It reads from the informer cache if there is one.
+func checkRuleFile() error {
+	manager := &RulesManager{cached: true}
+	if err := manager.load(); err != nil {
+		return err
+	}
+	if len(manager.parseErrors) > 0 {
+		return fmt.Errorf("rule file has errors: %v", manager.parseErrors)
+	}
+	return nil
+}
+
+// update applies mutate to the rule groups and writes them back. If the
+// ConfigMap was changed concurrently, it is read again and mutate is re-applied.
+// The change is announced to the listeners with the given description.
+func (manager *RulesManager) update(description string, mutate func() error) error {
+	inflightWrites.Add(1)
+	defer inflightWrites.Done()
+
+	first := true
+	// Another writer may create the ConfigMap between our read and create.
+	retriable := func(err error) bool {
+		return apierrors.IsConflict(err) || apierrors.IsAlreadyExists(err)
+	}
+	var before []SimpleRuleGroup
+	err := retry.OnError(retry.DefaultRetry, retriable, func() error {
+		if !first {
+			conflictRetries.Inc()
+			if err := manager.load(); err != nil {
+				return err
+			}
+		}
+		first = false
+		manager.originals = nil
+		before = snapshot(manager.ruleGroups)
+		if err := mutate(); err != nil {
+			return err
+		}
+		return manager.save()
+	})
 	if err != nil {
-		panic(err.Error())
-	}
-	ruleGroups, errors := Parse([]byte(rulesConfig.Data[rulefileName]))
-	if len(errors) > 0 {
-		fmt.Println(errors)
-	}
-
-	// opts := &rules.ManagerOptions{}
-
-	// groups := make(map[string]*rules.Group)
-	// for _, rg := range rgs.Groups {
-	// 	itv := interval
-	// 	if rg.Interval != 0 {
-	// 		itv = time.Duration(rg.Interval)
-	// 	}
-
-	// 	groupRules := make([]rules.Rule, 0, len(rg.Rules))
-	// 	for _, r := range rg.Rules {
-	// 		expr, err := groupLoader.Parse(r.Expr.Value)
-	// 		if err != nil {
-	// 			panic(fmt.Errorf("%s: %w", filename, err))
-	// 		}
-
-	// 		if r.Alert.Value != "" {
-	// 			groupRules = append(groupRules, rules.NewAlertingRule(
-	// 				r.Alert.Value,
-	// 				expr,
-	// 				time.Duration(r.For),
-	// 				time.Duration(r.KeepFiringFor),
-	// 				labels.FromMap(r.Labels),
-	// 				labels.FromMap(r.Annotations),
-	// 				externalLabels,
-	// 				externalURL,
-	// 				false,
-	// 				log.With(logger, "alert", r.Alert),
-	// 			))
-
-	// 			fmt.Println(fmt.Sprintf("%+v", groupRules[0]))
-	// 			continue
-	// 		}
-	// 		groupRules = append(groupRules, rules.NewRecordingRule(
-	// 			r.Record.Value,
-	// 			expr,
-	// 			labels.FromMap(r.Labels),
-	// 		))
-	// 	}
-
-	// 	groups[rules.GroupKey(filename, rg.Name)] = rules.NewGroup(rules.GroupOptions{
-	// 		Name:              rg.Name,
-	// 		File:              filename,
-	// 		Interval:          itv,
-	// 		Limit:             rg.Limit,
-	// 		Rules:             groupRules,
-	// 		ShouldRestore:     false,
-	// 		Opts:              opts,
-	// 		EvalIterationFunc: nil,
-	// 	})
-	// }
-
-	// fmt.Println(fmt.Sprintf("%+v", groups))
-
-	return &RulesManager{ruleGroups}
+		return err
+	}
+	notifyChange(Change{
+		Time:        time.Now(),
+		Actor:       manager.actor,
+		Description: description,
+		Before:      before,
+		After:       snapshot(manager.ruleGroups),
+		Originals:   manager.originals,
+	})
+	return nil
 }
 
-func (manager *RulesManager) AddRules(newRuleGroup SimpleRuleGroup) error {
-	fmt.Println(fmt.Sprintf("AddRules: %+v\n", newRuleGroup))
+// save writes the rule groups back to the ConfigMaps. Only shards whose rule
+// file changed are written.
+func (manager *RulesManager) save() error {
+	// Owners of removed groups are dropped by every write, whichever
+	// removed them.
+	manager.setOwners(manager.owners())
+	manager.storeSubmittedExprs()
+	previous := manager.groupShards
+	contents, err := manager.shardContents()
+	if err != nil {
+		return err
+	}
+
+	size := 0
+	for _, i := range manager.writeOrder(previous) {
+		s := manager.shards[i]
+		size += len(contents[i])
+		annotations := map[string]interface{}{}
+		if i == 0 {
+			for k, v := range manager.annotations {
+				if s.annotations[k] != v {
+					annotations[k] = v
+				}
+			}
+		}
+		for k := range s.annotations {
+			if _, ok := manager.annotations[k]; (!ok || i != 0) && strings.HasPrefix(k, annotationPrefix) && k != checksumAnnotation {
+				// Removes the annotation with a merge patch. The state
+				// left on retired shards was moved to the first one.
+				annotations[k] = nil
+			}
+		}
+		if sum := checksum(contents[i]); s.annotations[checksumAnnotation] != sum {
+			annotations[checksumAnnotation] = sum
+		}
+		if s.missing {
+			if err := s.createConfigMap(contents[i], annotations); err != nil {
+				level.Error(logger).Log("msg", "Failed to create ConfigMap", "configmap", s.configMap, "err", err)
+				return err
+			}
+			recordWritten(s.configMap, contents[i])
+			continue
+		}
+		if contents[i] == s.content && len(annotations) == 0 {
+			recordWritten(s.configMap, contents[i])
+			continue
+		}
+		// Patch the ConfigMap
+		dataValue := map[string]string{
+			s.key: contents[i],
+		}
+		metadata := map[string]interface{}{"resourceVersion": s.resourceVersion}
+		if len(annotations) > 0 {
+			metadata["annotations"] = annotations
+		}
+		err = s.updateConfigMap(map[string]interface{}{
+			"metadata": metadata,
+			"data":     dataValue,
+		})
+		if err != nil {
+			level.Error(logger).Log("msg", "Failed to patch ConfigMap", "configmap", s.configMap, "err", err)
+			return err
+		}
+		s.content = contents[i]
+		recordWritten(s.configMap, contents[i])
+	}
+
+	lastWriteSuccess.SetToCurrentTime()
+	updateRuleMetrics(manager.ruleGroups, size)
+	level.Debug(logger).Log("msg", "Rules ConfigMaps written", "groups", len(manager.ruleGroups.Groups))
+	return nil
+}
+
+// writeOrder returns the order to write the shards in: shards gaining groups
+// first and shards losing groups last. Every write is atomic, so a save
+// interrupted between two shards leaves a moved group on both shards rather
+// than on none.
+func (manager *RulesManager) writeOrder(previous map[string]int) []int {
+	losing := make([]bool, len(manager.shards))
+	for i, s := range manager.shards {
+		// Retired shards may only hold state moved to the first shard.
+		losing[i] = s.retired
+	}
+	for group, i := range previous {
+		if j, ok := manager.groupShards[group]; (!ok || j != i) && i < len(losing) {
+			losing[i] = true
+		}
+	}
+	order := make([]int, 0, len(manager.shards))
+	for _, last := range []bool{false, true} {
+		for i := range manager.shards {
+			if losing[i] == last {
+				order = append(order, i)
+			}
+		}
+	}
+	return order
+}
+
+// inflightWrites tracks the writes in progress, so that shutdown waits for
+// them.
+var inflightWrites sync.WaitGroup
+
+// waitForWrites waits for the writes in progress to finish. It returns false
+// if they are still in progress after timeout.
+func waitForWrites(timeout time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		inflightWrites.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// addRulesOp adds the rules of newRuleGroup, updating the rules with the same
+// alert name and expression.
+func addRulesOp(newRuleGroup SimpleRuleGroup) writeOp {
+	return writeOp{
+		description: fmt.Sprintf("Add rules to group %q", newRuleGroup.Name),
+		mutate: func(manager *RulesManager) error {
+			manager.addRules(manager.canonicalizeGroup(newRuleGroup))
+			return nil
+		},
+	}
+}
+
+func (manager *RulesManager) addRules(newRuleGroup SimpleRuleGroup) {
+	// Matched rules are dropped from the slice below, keep the caller's intact.
+	newRuleGroup.Rules = slices.Clone(newRuleGroup.Rules)
 
 	for i, ruleGroup := range manager.ruleGroups.Groups {
-		fmt.Println(fmt.Sprintf("In forrange, ruleGroup %s address: %p\n", ruleGroup.Name, &ruleGroup))
 		if ruleGroup.Name == newRuleGroup.Name {
-			for _, existingRule := range ruleGroup.Rules {
+			for k := range ruleGroup.Rules {
+				existingRule := &manager.ruleGroups.Groups[i].Rules[k]
 				for j, newRule := range newRuleGroup.Rules {
-					if existingRule.Alert.Value == newRule.Alert && existingRule.Expr.Value == newRule.Expr {
+					if existingRule.Alert.Value == newRule.Alert && sameExpr(existingRule.Expr.Value, newRule.Expr) {
 						// Update an old rule
 						existingRule.For = newRule.For
 						existingRule.KeepFiringFor = newRule.KeepFiringFor
@@ -134,107 +442,262 @@ func (manager *RulesManager) AddRules(newRuleGroup SimpleRuleGroup) error {
 			}
 			for _, newRule := range newRuleGroup.Rules {
 				// Add a new rule
-				newNodeRule := RuleNode{
-					For:           newRule.For,
-					KeepFiringFor: newRule.KeepFiringFor,
-					Labels:        newRule.Labels,
-					Annotations:   newRule.Annotations,
-				}
-				var recordNode, alertNode, exprNode yaml.Node
-				exprNode.SetString(newRule.Expr)
-				newNodeRule.Expr = exprNode
-				if newRule.Alert != "" {
-					alertNode.SetString(newRule.Alert)
-					newNodeRule.Alert = alertNode
-				}
-				if newRule.Record != "" {
-					recordNode.SetString(newRule.Record)
-					newNodeRule.Record = recordNode
-				}
+				newNodeRule := newRuleNode(newRule)
 				// ruleGroup.Rules = append(ruleGroup.Rules, newNodeRule)
 				manager.ruleGroups.Groups[i].Rules = append(manager.ruleGroups.Groups[i].Rules, newNodeRule)
-				fmt.Println(fmt.Sprintf("ruleGroup appended a newNodeRule: %+v\n", ruleGroup))
 			}
+			return
 		}
 	}
 
-	// Patch the ConfigMap
-	rulesData, err := yaml.Marshal(manager.ruleGroups)
-	if err != nil {
-		return err
+	// Add a new group
+	manager.ruleGroups.Groups = append(manager.ruleGroups.Groups, newRuleGroupNode(newRuleGroup))
+}
+
+// newRuleGroupNode converts a rule group into its yaml.v3 representation.
+func newRuleGroupNode(group SimpleRuleGroup) RuleGroup {
+	ruleGroup := RuleGroup{
+		Name:     group.Name,
+		Interval: group.Interval,
+		Limit:    group.Limit,
+		Rules:    make([]RuleNode, 0, len(group.Rules)),
+	}
+	for _, rule := range group.Rules {
+		ruleGroup.Rules = append(ruleGroup.Rules, newRuleNode(rule))
 	}
+	return ruleGroup
+}
 
-	fmt.Println(fmt.Sprintf("manager.ruleGroups: %+v", manager.ruleGroups))
-	dataValue := map[string]string{
-		rulefileName: string(rulesData),
+// newRuleNode converts a rule into its yaml.v3 representation.
+func newRuleNode(rule Rule) RuleNode {
+	node := RuleNode{
+		For:           rule.For,
+		KeepFiringFor: rule.KeepFiringFor,
+		Labels:        rule.Labels,
+		Annotations:   rule.Annotations,
 	}
-	err = manager.updateConfigMap(map[string]interface{}{"data": dataValue})
-	if err != nil {
-		fmt.Printf("Failed to patch ConfigMap: %v\n", err)
-		return err
+	node.Expr.SetString(rule.Expr)
+	if rule.Alert != "" {
+		node.Alert.SetString(rule.Alert)
+	}
+	if rule.Record != "" {
+		node.Record.SetString(rule.Record)
 	}
+	return node
+}
 
-	fmt.Println("Custom rules configmap patched successfully.")
-	return nil
+// newRule converts a rule from its yaml.v3 representation.
+func newRule(node RuleNode) Rule {
+	return Rule{
+		Record:        node.Record.Value,
+		Alert:         node.Alert.Value,
+		Expr:          node.Expr.Value,
+		For:           node.For,
+		KeepFiringFor: node.KeepFiringFor,
+		Labels:        node.Labels,
+		Annotations:   node.Annotations,
+	}
+}
+
+// newSimpleRuleGroup converts a rule group from its yaml.v3 representation.
+func newSimpleRuleGroup(group RuleGroup) SimpleRuleGroup {
+	simple := SimpleRuleGroup{
+		Name:     group.Name,
+		Interval: group.Interval,
+		Limit:    group.Limit,
+		Rules:    make([]Rule, 0, len(group.Rules)),
+	}
+	for _, node := range group.Rules {
+		simple.Rules = append(simple.Rules, newRule(node))
+	}
+	return simple
 }
 
-func (manager *RulesManager) RemoveRules(newRuleGroup SimpleRuleGroup) error {
-	fmt.Println(fmt.Sprintf("RemoveRules: %+v\n", newRuleGroup))
+// removeRulesOp deletes the rules with the alert names and expressions of
+// newRuleGroup's rules.
+func removeRulesOp(newRuleGroup SimpleRuleGroup) writeOp {
+	return writeOp{
+		description: fmt.Sprintf("Delete rules from group %q", newRuleGroup.Name),
+		mutate: func(manager *RulesManager) error {
+			manager.removeRules(newRuleGroup)
+			return nil
+		},
+	}
+}
 
+func (manager *RulesManager) removeRules(newRuleGroup SimpleRuleGroup) {
 	for i, ruleGroup := range manager.ruleGroups.Groups {
-		fmt.Println(fmt.Sprintf("In forrange, ruleGroup %s address: %p\n", ruleGroup.Name, &ruleGroup))
-		if ruleGroup.Name == newRuleGroup.Name {
-			for j, existingRule := range ruleGroup.Rules {
-				for _, newRule := range newRuleGroup.Rules {
-					if existingRule.Alert.Value == newRule.Alert && existingRule.Expr.Value == newRule.Expr {
-						// Delete an old rule
-						manager.ruleGroups.Groups[i].Rules = slices.Delete(manager.ruleGroups.Groups[i].Rules, j, j+1)
-						break
-					}
+		if ruleGroup.Name != newRuleGroup.Name {
+			continue
+		}
+		rules := make([]RuleNode, 0, len(ruleGroup.Rules))
+		for _, existingRule := range ruleGroup.Rules {
+			matched := false
+			for _, newRule := range newRuleGroup.Rules {
+				if existingRule.Alert.Value == newRule.Alert && sameExpr(existingRule.Expr.Value, newRule.Expr) {
+					matched = true
+					break
 				}
 			}
+			if !matched {
+				rules = append(rules, existingRule)
+			}
 		}
+		manager.ruleGroups.Groups[i].Rules = rules
 	}
+}
 
-	// Patch the ConfigMap
-	rulesData, err := yaml.Marshal(manager.ruleGroups)
+func (s *shard) updateConfigMap(patchData map[string]interface{}) error {
+	patchBytes, err := json.Marshal(patchData)
 	if err != nil {
 		return err
 	}
 
-	fmt.Println(fmt.Sprintf("manager.ruleGroups: %+v", manager.ruleGroups))
-	dataValue := map[string]string{
-		rulefileName: string(rulesData),
-	}
-	err = manager.updateConfigMap(map[string]interface{}{"data": dataValue})
+	// Create the PatchType object
+	patchType := types.MergePatchType
+
+	clientset, err := getClientset()
 	if err != nil {
-		fmt.Printf("Failed to patch ConfigMap: %v\n", err)
 		return err
 	}
 
-	fmt.Println("Custom rules configmap patched successfully.")
+	// Apply the patch
+	start := time.Now()
+	rulesConfig, err := clientset.CoreV1().ConfigMaps(namespace).Patch(context.TODO(), s.configMap, patchType, patchBytes, metav1.PatchOptions{
+		FieldManager: "client-go-patch",
+	})
+	observeConfigMap("write", start, err)
+	if err != nil {
+		return err
+	}
+	s.resourceVersion = rulesConfig.ResourceVersion
+	s.annotations = rulesConfig.Annotations
 	return nil
 }
 
-func (manager *RulesManager) updateConfigMap(patchData map[string]interface{}) error {
-	patchBytes, err := json.Marshal(patchData)
+// createConfigMap creates the shard's ConfigMap holding rulesData. The
+// annotations are set in addition to the configured ones.
+func (s *shard) createConfigMap(rulesData string, annotations map[string]interface{}) error {
+	clientset, err := getClientset()
 	if err != nil {
 		return err
 	}
 
-	// Create the PatchType object
-	patchType := types.MergePatchType
+	allAnnotations := map[string]string{}
+	for k, v := range *configMapAnnotations {
+		allAnnotations[k] = v
+	}
+	for k, v := range annotations {
+		if v, ok := v.(string); ok {
+			allAnnotations[k] = v
+		}
+	}
+	rulesConfig := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        s.configMap,
+			Namespace:   namespace,
+			Labels:      *configMapLabels,
+			Annotations: allAnnotations,
+		},
+		Data: map[string]string{
+			s.key: rulesData,
+		},
+	}
+	if *configMapOwner != "" {
+		ownerRef, err := getOwnerReference(clientset, *configMapOwner)
+		if err != nil {
+			return err
+		}
+		rulesConfig.OwnerReferences = []metav1.OwnerReference{*ownerRef}
+	}
 
-	// Apply the patch
-	_, err = clientset.CoreV1().ConfigMaps(namespace).Patch(context.TODO(), rulefileConfigMap, patchType, patchBytes, metav1.PatchOptions{
+	start := time.Now()
+	rulesConfig, err = clientset.CoreV1().ConfigMaps(namespace).Create(context.TODO(), rulesConfig, metav1.CreateOptions{
 		FieldManager: "client-go-patch",
 	})
+	observeConfigMap("write", start, err)
 	if err != nil {
 		return err
 	}
+	s.resourceVersion = rulesConfig.ResourceVersion
+	s.missing = false
+	s.content = rulesData
+	s.annotations = rulesConfig.Annotations
 	return nil
 }
 
+// ensureConfigMap creates the rules ConfigMaps with an empty rule file through
+// queue if they do not exist yet.
+func ensureConfigMap(ctx context.Context, queue *WriteQueue) error {
+	manager := &RulesManager{}
+	if err := manager.load(); err != nil {
+		return err
+	}
+	missing := false
+	for _, s := range manager.shards {
+		missing = missing || s.missing
+	}
+	if !missing {
+		return nil
+	}
+	// Every write creates the missing ConfigMaps.
+	return queue.Submit(ctx, "configmap-create", writeOp{
+		description: "Create the rules ConfigMaps",
+		mutate:      func(*RulesManager) error { return nil },
+	})
+}
+
+// getOwnerReference looks up the object described by owner, formatted as
+// <apiVersion>/<kind>/<name>, in the namespace of the rules ConfigMap.
+func getOwnerReference(clientset *kubernetes.Clientset, owner string) (*metav1.OwnerReference, error) {
+	parts := strings.Split(owner, "/")
+	if len(parts) < 3 || len(parts) > 4 {
+		return nil, fmt.Errorf("invalid owner %q, expected <apiVersion>/<kind>/<name>", owner)
+	}
+	n := len(parts)
+	apiVersion, kind, name := strings.Join(parts[:n-2], "/"), parts[n-2], parts[n-1]
+
+	gv, err := schema.ParseGroupVersion(apiVersion)
+	if err != nil {
+		return nil, err
+	}
+	resources, err := clientset.Discovery().ServerResourcesForGroupVersion(apiVersion)
+	if err != nil {
+		return nil, err
+	}
+	var resource string
+	for _, r := range resources.APIResources {
+		if r.Kind == kind && r.Namespaced && !strings.Contains(r.Name, "/") {
+			resource = r.Name
+			break
+		}
+	}
+	if resource == "" {
+		return nil, fmt.Errorf("no namespaced resource of kind %s in %s", kind, apiVersion)
+	}
+
+	path := []string{"/apis", gv.Group, gv.Version}
+	if gv.Group == "" {
+		path = []string{"/api", gv.Version}
+	}
+	path = append(path, "namespaces", namespace, resource, name)
+	body, err := clientset.Discovery().RESTClient().Get().AbsPath(path...).DoRaw(context.TODO())
+	if err != nil {
+		return nil, err
+	}
+	var object metav1.PartialObjectMetadata
+	if err := json.Unmarshal(body, &object); err != nil {
+		return nil, err
+	}
+
+	return &metav1.OwnerReference{
+		APIVersion: apiVersion,
+		Kind:       kind,
+		Name:       name,
+		UID:        object.UID,
+	}, nil
+}
+
 func getInClusterClient() (*kubernetes.Clientset, error) {
 	// creates the in-cluster config
 	config, err := rest.InClusterConfig()
@@ -242,7 +705,7 @@ func getInClusterClient() (*kubernetes.Clientset, error) {
 		return nil, err
 	}
 	// creates the clientset
-	clientset, err = kubernetes.NewForConfig(config)
+	clientset, err := kubernetes.NewForConfig(config)
 	if err != nil {
 		return nil, err
 	}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/alecthomas/kingpin"
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/informers"
+	listersv1 "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+)
+
+// proxiedHeader marks requests proxied from a follower to the leader, so that
+// they are never proxied again.
+const proxiedHeader = "X-Rules-Manager-Proxied"
+
+var (
+	leaderElect         = kingpin.Flag("leader-election.enabled", "Elect a leader among the replicas through a Lease. Only the leader writes the rules ConfigMap and runs background loops.").Default("false").Bool()
+	leaderLeaseName     = kingpin.Flag("leader-election.lease-name", "Name of the Lease used for leader election.").Default("prom-rules-manager").String()
+	leaderLeaseDuration = kingpin.Flag("leader-election.lease-duration", "Duration followers wait before taking over the leadership.").Default("15s").Duration()
+	leaderRenewDeadline = kingpin.Flag("leader-election.renew-deadline", "Duration the leader retries renewing the leadership before giving it up.").Default("10s").Duration()
+	leaderRetryPeriod   = kingpin.Flag("leader-election.retry-period", "Interval between attempts to acquire or renew the leadership.").Default("2s").Duration()
+	leaderAdvertiseURL  = kingpin.Flag("leader-election.advertise-url", "URL the other replicas reach this replica at, it is also the identity in the Lease. Defaults to http://<hostname>:<listen port>.").Default("").String()
+	leaderProxy         = kingpin.Flag("leader-election.proxy", "Proxy mutating requests received by followers to the leader instead of answering 503.").Default("true").Bool()
+)
+
+// errLostLeadership stops the manager when the leadership is lost, so that
+// background loops never run on two replicas.
+var errLostLeadership = errors.New("leadership lost")
+
+// configMapLister holds a listersv1.ConfigMapNamespaceLister serving reads
+// from an informer cache once leader election has started.
+var configMapLister atomic.Value
+
+// LeaderStatus describes the leader election from the view of a replica.
+type LeaderStatus struct {
+	Identity string `json:"identity"`
+	Leader   string `json:"leader"`
+	IsLeader bool   `json:"isLeader"`
+}
+
+// LeaderElection elects the replica writing the rules ConfigMap.
+type LeaderElection struct {
+	logger   log.Logger
+	identity string
+	proxy    bool
+
+	mtx     sync.RWMutex
+	elector *leaderelection.LeaderElector
+	// leading is closed once this replica leads.
+	leading chan struct{}
+}
+
+// NewLeaderElection returns a LeaderElection for the configured Lease.
+func NewLeaderElection(logger log.Logger) (*LeaderElection, error) {
+	identity := *leaderAdvertiseURL
+	if identity == "" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			return nil, err
+		}
+		_, port, err := net.SplitHostPort(ListenAddress)
+		if err != nil {
+			return nil, err
+		}
+		identity = fmt.Sprintf("http://%s", net.JoinHostPort(hostname, port))
+	}
+	if _, err := url.Parse(identity); err != nil {
+		return nil, fmt.Errorf("invalid advertise URL %q: %w", identity, err)
+	}
+	return &LeaderElection{
+		logger:   logger,
+		identity: identity,
+		proxy:    *leaderProxy,
+		leading:  make(chan struct{}),
+	}, nil
+}
+
+// Run takes part in the election until ctx is canceled. It returns
+// errLostLeadership once this replica stops leading.
+func (l *LeaderElection) Run(ctx context.Context) error {
+	clientset, err := getClientset()
+	for err != nil {
+		level.Warn(l.logger).Log("msg", "Kubernetes cluster is unavailable, waiting to join the leader election", "err", err)
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(*leaderRetryPeriod):
+		}
+		clientset, err = getClientset()
+	}
+
+	// Reads are served from the informer cache on every replica.
+	factory := informers.NewSharedInformerFactoryWithOptions(clientset, 0, informers.WithNamespace(namespace))
+	configMaps := factory.Core().V1().ConfigMaps()
+	configMaps.Informer()
+	factory.Start(ctx.Done())
+	if !cache.WaitForCacheSync(ctx.Done(), configMaps.Informer().HasSynced) {
+		return nil
+	}
+	configMapLister.Store(configMaps.Lister().ConfigMaps(namespace))
+
+	elector, err := leaderelection.NewLeaderElector(leaderelection.LeaderElectionConfig{
+		Lock: &resourcelock.LeaseLock{
+			LeaseMeta: metav1.ObjectMeta{
+				Name:      *leaderLeaseName,
+				Namespace: namespace,
+			},
+			Client:     clientset.CoordinationV1(),
+			LockConfig: resourcelock.ResourceLockConfig{Identity: l.identity},
+		},
+		LeaseDuration:   *leaderLeaseDuration,
+		RenewDeadline:   *leaderRenewDeadline,
+		RetryPeriod:     *leaderRetryPeriod,
+		ReleaseOnCancel: true,
+		Name:            *leaderLeaseName,
+		Callbacks: leaderelection.LeaderCallbacks{
+			OnStartedLeading: func(context.Context) {
+				level.Info(l.logger).Log("msg", "Started leading", "identity", l.identity)
+				close(l.leading)
+			},
+			OnStoppedLeading: func() {
+				level.Info(l.logger).Log("msg", "Stopped leading", "identity", l.identity)
+			},
+			OnNewLeader: func(identity string) {
+				level.Info(l.logger).Log("msg", "New leader elected", "leader", identity)
+			},
+		},
+	})
+	if err != nil {
+		return err
+	}
+	l.mtx.Lock()
+	l.elector = elector
+	l.mtx.Unlock()
+
+	elector.Run(ctx)
+	select {
+	case <-l.leading:
+		if ctx.Err() == nil {
+			return errLostLeadership
+		}
+	default:
+	}
+	return nil
+}
+
+// IsLeader reports whether this replica leads.
+func (l *LeaderElection) IsLeader() bool {
+	l.mtx.RLock()
+	defer l.mtx.RUnlock()
+	return l.elector != nil && l.elector.IsLeader()
+}
+
+// Leader returns the URL of the leader, empty if unknown.
+func (l *LeaderElection) Leader() string {
+	l.mtx.RLock()
+	defer l.mtx.RUnlock()
+	if l.elector == nil {
+		return ""
+	}
+	return l.elector.GetLeader()
+}
+
+// Wait blocks until this replica leads. It returns false if ctx is canceled
+// first.
+func (l *LeaderElection) Wait(ctx context.Context) bool {
+	select {
+	case <-l.leading:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// leaderOnly serves mutating requests on the leader. Followers proxy them to
+// the leader, or answer 503 naming the leader.
+func (h *Handler) leaderOnly(f http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		l := h.options.LeaderElection
+		if l == nil || l.IsLeader() {
+			f(w, r)
+			return
+		}
+		leader := l.Leader()
+		if leader != "" && leader != l.identity && l.proxy && r.Header.Get(proxiedHeader) == "" {
+			target, err := url.Parse(leader)
+			if err == nil {
+				r.Header.Set(proxiedHeader, l.identity)
+				proxy := httputil.NewSingleHostReverseProxy(target)
+				proxy.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
+					level.Error(h.logger).Log("msg", "Proxying to the leader failed", "leader", leader, "err", err)
+					w.WriteHeader(http.StatusBadGateway)
+					fmt.Fprintf(w, "Request cannot be proxied to the leader %s: %s\n", leader, err)
+				}
+				proxy.ServeHTTP(w, r)
+				return
+			}
+		}
+		if leader != "" {
+			w.Header().Set("X-Rules-Manager-Leader", leader)
+		}
+		w.Header().Set("Retry-After", fmt.Sprintf("%d", int(leaderRetryPeriod.Seconds())))
+		w.WriteHeader(http.StatusServiceUnavailable)
+		if leader == "" {
+			fmt.Fprintf(w, "This replica is not the leader and no leader is elected yet, retry later.\n")
+			return
+		}
+		fmt.Fprintf(w, "This replica is not the leader, send the request to %s.\n", leader)
+	}
+}
+
+// getCachedConfigMap returns a ConfigMap from the informer cache if there is
+// one, else from the API server.
+func getCachedConfigMap(ctx context.Context, name string) (*corev1.ConfigMap, error) {
+	if lister, ok := configMapLister.Load().(listersv1.ConfigMapNamespaceLister); ok {
+		return lister.Get(name)
+	}
+	clientset, err := getClientset()
+	if err != nil {
+		return nil, err
+	}
+	return clientset.CoreV1().ConfigMaps(namespace).Get(ctx, name, metav1.GetOptions{})
+}
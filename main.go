@@ -4,12 +4,15 @@ import (
 	"context"
 	"fmt"
 	"os"
+	"os/signal"
+	"syscall"
 
 	"github.com/alecthomas/kingpin"
 	"github.com/go-kit/log"
 	"github.com/go-kit/log/level"
 	"github.com/oklog/run"
 	"github.com/prometheus/common/promlog"
+	"github.com/prometheus/common/version"
 )
 
 var (
@@ -17,28 +20,138 @@ var (
 	// filename       = "rules.yaml"
 	// interval       = 10 * time.Second
 	standaloneMode = kingpin.Flag("standalone", "Enable standalone mode, used for out of a K8s cluster.").Default("false").Bool()
+	drainTimeout   = kingpin.Flag("web.drain-timeout", "Time in-flight requests and writes are given to finish on shutdown.").Default("30s").Duration()
 	logger         = promlog.New(&promlog.Config{})
+
+	serveCmd = kingpin.Command("serve", "Run the rules manager, configured by the global flags. This is the default command.").Default()
 )
 
 func init() {
 }
 
 func main() {
+	kingpin.Version(version.Print("prom-rules-manager"))
+	switch command := kingpin.Parse(); command {
+	case serveCmd.FullCommand():
+		serve()
+	case checkCmd.FullCommand():
+		os.Exit(check(os.Stdout, *checkFiles))
+	case fmtCmd.FullCommand():
+		os.Exit(formatFiles(os.Stdout, *fmtFiles))
+	default:
+		os.Exit(runClient(command))
+	}
+}
+
+// serve runs the rules manager until it is terminated.
+func serve() {
 	level.Info(logger).Log("standaloneMode", *standaloneMode)
+	if err := validateConflictPolicies(); err != nil {
+		level.Error(logger).Log("msg", "Invalid conflict policy", "err", err)
+		os.Exit(1)
+	}
+	if err := parseTrustedProxies(); err != nil {
+		level.Error(logger).Log("msg", "Invalid trusted proxy", "err", err)
+		os.Exit(1)
+	}
+	_, clientErr := getClientset()
+	if clientErr != nil {
+		// Keep serving, the client is built again on the next request.
+		level.Warn(logger).Log("msg", "Kubernetes cluster is unavailable, starting in degraded mode", "err", clientErr)
+	}
 	ctxWeb, cancelWeb := context.WithCancel(context.Background())
 
-	webHandler := NewHandler(log.With(logger, "component", "web"))
+	webOptions := &Options{
+		DrainTimeout: *drainTimeout,
+		WriteQueue:   NewWriteQueue(log.With(logger, "component", "write-queue")),
+		Watcher:      NewWatcher(log.With(logger, "component", "watch")),
+	}
+	if *prometheusURL != "" {
+		checker, err := NewExprChecker(*prometheusURL, *checkTimeout, *checkMaxCardinality, *checkMaxRecordSeries)
+		if err != nil {
+			level.Error(logger).Log("msg", "Unable to create the expression checker", "err", err)
+			os.Exit(1)
+		}
+		webOptions.ExprChecker = checker
+	}
+	webOptions.AlertRenderer = NewAlertRenderer(*alertExternalLabels, *alertExternalURL, webOptions.ExprChecker)
+	if *gitRepository != "" {
+		webOptions.GitSync = NewGitSync(log.With(logger, "component", "git-sync"), webOptions.WriteQueue)
+	}
+	var webhooks *Webhooks
+	if *webhookConfigFile != "" {
+		var err error
+		webhooks, err = LoadWebhooks(log.With(logger, "component", "webhooks"), *webhookConfigFile, webOptions.Watcher)
+		if err != nil {
+			level.Error(logger).Log("msg", "Unable to load the webhook config file", "err", err)
+			os.Exit(1)
+		}
+		level.Info(logger).Log("msg", "Webhooks loaded", "webhooks", webhooks.names())
+	}
+	if *idempotencyTTL > 0 {
+		webOptions.Idempotency = NewIdempotencyStore(log.With(logger, "component", "idempotency"))
+	}
+	if *leaderElect {
+		le, err := NewLeaderElection(log.With(logger, "component", "leader-election"))
+		if err != nil {
+			level.Error(logger).Log("msg", "Unable to set up leader election", "err", err)
+			os.Exit(1)
+		}
+		webOptions.LeaderElection = le
+	}
+	if *driftInterval > 0 {
+		webOptions.DriftReconciler = NewDriftReconciler(log.With(logger, "component", "drift"), webOptions.WriteQueue)
+	}
+
+	webHandler := NewHandler(log.With(logger, "component", "web"), webOptions)
 	listener, err := webHandler.Listener()
 	if err != nil {
 		level.Error(logger).Log("msg", "Unable to start web listener", "err", err)
 		os.Exit(1)
 	}
 
+	ctxWrite, cancelWrite := context.WithCancel(context.Background())
+	if clientErr == nil {
+		// Only the leader writes, once the write queue runs.
+		go func() {
+			if webOptions.LeaderElection != nil && !webOptions.LeaderElection.Wait(ctxWrite) {
+				return
+			}
+			if *configMapCreate {
+				if err := ensureConfigMap(ctxWrite, webOptions.WriteQueue); err != nil {
+					level.Warn(logger).Log("msg", "Unable to create the rules ConfigMap, it is created on the first write", "err", err)
+				}
+			}
+			if err := migrateShards(ctxWrite, webOptions.WriteQueue); err != nil {
+				level.Warn(logger).Log("msg", "Unable to move the rule groups to the configured shards, they are moved on the next write", "err", err)
+			}
+		}()
+	}
 	var g run.Group
+	{
+		// Termination handler.
+		term := make(chan os.Signal, 1)
+		signal.Notify(term, os.Interrupt, syscall.SIGTERM)
+		cancel := make(chan struct{})
+		g.Add(
+			func() error {
+				select {
+				case sig := <-term:
+					level.Warn(logger).Log("msg", "Received signal, exiting gracefully...", "signal", sig)
+				case <-cancel:
+				}
+				return nil
+			},
+			func(err error) {
+				close(cancel)
+			},
+		)
+	}
 	{
 		// Web handler.
 		g.Add(
 			func() error {
+				defer cancelWrite()
 				if err := webHandler.Run(ctxWeb, listener, ""); err != nil {
 					return fmt.Errorf("error starting web server: %w", err)
 				}
@@ -49,7 +162,77 @@ func main() {
 			},
 		)
 	}
-	if err := g.Run(); err != nil {
+	{
+		// Write queue. It is closed once the web handler drained the
+		// in-flight requests, and writes the queued ones before returning.
+		g.Add(
+			func() error {
+				return webOptions.WriteQueue.Run(ctxWrite)
+			},
+			func(err error) {},
+		)
+	}
+	if webhooks != nil {
+		// Webhooks.
+		ctxWebhooks, cancelWebhooks := context.WithCancel(context.Background())
+		g.Add(
+			func() error {
+				return webhooks.Run(ctxWebhooks)
+			},
+			func(err error) {
+				cancelWebhooks()
+			},
+		)
+	}
+	if webOptions.LeaderElection != nil {
+		// Leader election. Background loops only run on the leader, the
+		// manager stops when it loses the leadership.
+		ctxLeader, cancelLeader := context.WithCancel(context.Background())
+		g.Add(
+			func() error {
+				return webOptions.LeaderElection.Run(ctxLeader)
+			},
+			func(err error) {
+				cancelLeader()
+			},
+		)
+	}
+	if webOptions.GitSync != nil {
+		// Git sync.
+		ctxGit, cancelGit := context.WithCancel(context.Background())
+		g.Add(
+			func() error {
+				if webOptions.LeaderElection != nil && !webOptions.LeaderElection.Wait(ctxGit) {
+					return nil
+				}
+				return webOptions.GitSync.Run(ctxGit)
+			},
+			func(err error) {
+				cancelGit()
+			},
+		)
+	}
+	if webOptions.DriftReconciler != nil {
+		// Drift reconciler.
+		ctxDrift, cancelDrift := context.WithCancel(context.Background())
+		g.Add(
+			func() error {
+				if webOptions.LeaderElection != nil && !webOptions.LeaderElection.Wait(ctxDrift) {
+					return nil
+				}
+				return webOptions.DriftReconciler.Run(ctxDrift)
+			},
+			func(err error) {
+				cancelDrift()
+			},
+		)
+	}
+	err = g.Run()
+	// Requests cut off by the drain timeout may still be writing.
+	if !waitForWrites(*drainTimeout) {
+		level.Warn(logger).Log("msg", "Writes still in flight after the drain timeout")
+	}
+	if err != nil {
 		level.Error(logger).Log("err", err)
 		os.Exit(1)
 	}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/prometheus/common/version"
+)
+
+const metricsNamespace = "rules_manager"
+
+var (
+	requestCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "http_requests_total",
+			Help:      "Counter of HTTP requests.",
+		},
+		[]string{"handler", "code"},
+	)
+	requestDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "http_request_duration_seconds",
+			Help:      "Histogram of latencies for HTTP requests.",
+			Buckets:   []float64{.05, .1, .25, .5, 1, 2.5, 5, 10, 30},
+		},
+		[]string{"handler"},
+	)
+	configMapDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "configmap_operation_duration_seconds",
+			Help:      "Histogram of latencies for reads and writes of the rules ConfigMap.",
+			Buckets:   prometheus.DefBuckets,
+		},
+		[]string{"operation"},
+	)
+	configMapFailures = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "configmap_operation_failures_total",
+			Help:      "Total number of failed reads and writes of the rules ConfigMap.",
+		},
+		[]string{"operation"},
+	)
+	conflictRetries = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "configmap_conflict_retries_total",
+			Help:      "Total number of writes retried because the rules ConfigMap changed concurrently.",
+		},
+	)
+	validationFailures = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "validation_failures_total",
+			Help:      "Total number of validation failures by type.",
+		},
+		[]string{"type"},
+	)
+	ruleGroupsCount = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "rule_groups",
+			Help:      "Current number of rule groups.",
+		},
+	)
+	rulesCount = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "rules",
+			Help:      "Current number of rules by type.",
+		},
+		[]string{"type"},
+	)
+	rulefileSize = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "rulefile_size_bytes",
+			Help:      "Size of the rule file in bytes.",
+		},
+	)
+	lastWriteSuccess = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "last_write_success_timestamp_seconds",
+			Help:      "Timestamp of the last successful write of the rule file.",
+		},
+	)
+	gitSyncLastSuccess = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "git_sync_last_success_timestamp_seconds",
+			Help:      "Timestamp of the last successful sync from the Git repository.",
+		},
+	)
+	gitSyncFailures = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "git_sync_failures_total",
+			Help:      "Total number of failed syncs from the Git repository.",
+		},
+	)
+	gitSyncCommit = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "git_sync_commit_info",
+			Help:      "Commit of the Git repository last synced from.",
+		},
+		[]string{"commit"},
+	)
+	configMapDrift = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "configmap_drift",
+			Help:      "Whether the rules ConfigMap differs from the rule file last written by the manager.",
+		},
+		[]string{"configmap"},
+	)
+	writeQueueLength = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "write_queue_length",
+			Help:      "Current number of writes waiting in the queue.",
+		},
+	)
+	writeBatchSize = prometheus.NewHistogram(
+		prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "write_batch_size",
+			Help:      "Histogram of the number of writes applied in a single update.",
+			Buckets:   []float64{1, 2, 5, 10, 25, 50, 100},
+		},
+	)
+	writeQueueRejections = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "write_queue_rejections_total",
+			Help:      "Total number of writes rejected because the queue or the actor's share of it was full.",
+		},
+		[]string{"reason"},
+	)
+	webhookDeliveries = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "webhook_deliveries_total",
+			Help:      "Total number of webhook delivery attempts by webhook and result.",
+		},
+		[]string{"webhook", "result"},
+	)
+	ruleConflicts = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "rule_conflicts",
+			Help:      "Current number of duplicate or conflicting pairs of rules by kind.",
+		},
+		[]string{"kind"},
+	)
+	ruleConflictRejections = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "rule_conflict_rejections_total",
+			Help:      "Total number of writes rejected for introducing conflicting rules by kind.",
+		},
+		[]string{"kind"},
+	)
+	configMapDriftDetected = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "configmap_drift_detected_total",
+			Help:      "Total number of changes of the rules ConfigMap made outside of the manager.",
+		},
+	)
+)
+
+// Validation failure types.
+const (
+	validationDecode    = "decode"
+	validationParse     = "parse"
+	validationLiveCheck = "live_check"
+)
+
+func init() {
+	prometheus.MustRegister(
+		requestCounter,
+		requestDuration,
+		configMapDuration,
+		configMapFailures,
+		conflictRetries,
+		validationFailures,
+		ruleGroupsCount,
+		rulesCount,
+		rulefileSize,
+		lastWriteSuccess,
+		gitSyncLastSuccess,
+		gitSyncFailures,
+		gitSyncCommit,
+		configMapDrift,
+		configMapDriftDetected,
+		writeQueueLength,
+		writeBatchSize,
+		writeQueueRejections,
+		webhookDeliveries,
+		ruleConflicts,
+		ruleConflictRejections,
+		version.NewCollector("prom_rules_manager"),
+	)
+}
+
+// instrumentHandler records request count, status and latency for handlerName.
+func instrumentHandler(handlerName string, handler http.HandlerFunc) http.HandlerFunc {
+	requestCounter.WithLabelValues(handlerName, "200")
+	return promhttp.InstrumentHandlerCounter(
+		requestCounter.MustCurryWith(prometheus.Labels{"handler": handlerName}),
+		promhttp.InstrumentHandlerDuration(
+			requestDuration.MustCurryWith(prometheus.Labels{"handler": handlerName}),
+			handler,
+		),
+	)
+}
+
+// observeConfigMap records the latency and outcome of a ConfigMap operation.
+func observeConfigMap(operation string, start time.Time, err error) {
+	configMapDuration.WithLabelValues(operation).Observe(time.Since(start).Seconds())
+	if err != nil {
+		configMapFailures.WithLabelValues(operation).Inc()
+	}
+}
+
+// updateRuleMetrics sets the gauges describing the current rule file.
+func updateRuleMetrics(groups *RuleGroups, size int) {
+	var alerting, recording int
+	if groups != nil {
+		for _, g := range groups.Groups {
+			for _, r := range g.Rules {
+				if r.Alert.Value != "" {
+					alerting++
+				} else {
+					recording++
+				}
+			}
+		}
+		ruleGroupsCount.Set(float64(len(groups.Groups)))
+	}
+	rulesCount.WithLabelValues("alerting").Set(float64(alerting))
+	rulesCount.WithLabelValues("recording").Set(float64(recording))
+	rulefileSize.Set(float64(size))
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"net/http"
+	"reflect"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/common/model"
+)
+
+// durationPattern matches the durations accepted by model.ParseDuration.
+const durationPattern = `^(([0-9]+)y)?(([0-9]+)w)?(([0-9]+)d)?(([0-9]+)h)?(([0-9]+)m)?(([0-9]+)s)?(([0-9]+)ms)?$`
+
+var (
+	durationType = reflect.TypeOf(model.Duration(0))
+	timeType     = reflect.TypeOf(time.Time{})
+
+	pathParam = regexp.MustCompile(`\{([^}]+)\}`)
+)
+
+// apiOperation describes an operation of the v1 API for the OpenAPI
+// document.
+type apiOperation struct {
+	id      string
+	method  string
+	path    string
+	summary string
+	query   []string
+	// request and response are values of the JSON bodies, nil if the body is
+	// not JSON.
+	request  interface{}
+	response interface{}
+	// requestType and responseType are the media types of the bodies which
+	// are not JSON.
+	requestType  string
+	responseType string
+}
+
+// apiOperations are the operations served under apiV1Prefix. Request and
+// response schemas are generated from the Go types, so the document cannot
+// drift from what the handlers decode.
+var apiOperations = []apiOperation{
+	{id: "listGroups", method: http.MethodGet, path: "/groups", summary: "List the rule groups.", response: []SimpleRuleGroup{}},
+	{id: "getGroup", method: http.MethodGet, path: "/groups/{group}", summary: "Get a rule group.", response: SimpleRuleGroup{}},
+	{id: "putGroup", method: http.MethodPut, path: "/groups/{group}", summary: "Create or replace a rule group.", query: []string{"dryRun"}, request: SimpleRuleGroup{}, responseType: "text/plain"},
+	{id: "deleteGroup", method: http.MethodDelete, path: "/groups/{group}", summary: "Delete a rule group.", query: []string{"dryRun"}, responseType: "text/plain"},
+	{id: "submittedExprs", method: http.MethodGet, path: "/groups/{group}/submitted-exprs", summary: "List the expressions the formatted rules of a group were submitted with.", response: []SubmittedExpr{}},
+	{id: "addRules", method: http.MethodPost, path: "/groups/{group}/rules", summary: "Add rules to a group, updating the rules with the same name and expression.", query: []string{"dryRun"}, request: []Rule{}, responseType: "text/plain"},
+	{id: "deleteRule", method: http.MethodDelete, path: "/groups/{group}/rules/{rule}", summary: "Delete the rules with the given name, only those with the given expression if expr is set.", query: []string{"expr", "dryRun"}, responseType: "text/plain"},
+	{id: "applyRules", method: http.MethodPut, path: "/rules", summary: "Converge the groups owned by a source to a rule file.", query: []string{"source", "force", "dryRun"}, requestType: "application/yaml", response: ApplyPlan{}},
+	{id: "validateRules", method: http.MethodPost, path: "/rules/validate", summary: "Validate a rule group without writing it.", request: SimpleRuleGroup{}, response: ValidationResult{}},
+	{id: "renderRule", method: http.MethodPost, path: "/rules/render", summary: "Render the alerts of an alerting rule.", request: RenderRequest{}, response: []RenderedAlert{}},
+	{id: "watchRules", method: http.MethodGet, path: "/rules/watch", summary: "Stream the committed changes as Server-Sent Events.", query: []string{"since"}, responseType: "text/event-stream"},
+	{id: "listConflicts", method: http.MethodGet, path: "/conflicts", summary: "List the duplicate and conflicting rules across groups.", response: []Conflict{}},
+	{id: "listTemplates", method: http.MethodGet, path: "/templates", summary: "List the rule templates.", response: []Template{}},
+	{id: "getTemplate", method: http.MethodGet, path: "/templates/{name}", summary: "Get a rule template.", response: Template{}},
+	{id: "putTemplate", method: http.MethodPut, path: "/templates/{name}", summary: "Create or update a rule template, rendering its instances again.", query: []string{"dryRun"}, request: Template{}, responseType: "text/plain"},
+	{id: "deleteTemplate", method: http.MethodDelete, path: "/templates/{name}", summary: "Delete a rule template without instances.", query: []string{"dryRun"}, responseType: "text/plain"},
+	{id: "listTemplateInstances", method: http.MethodGet, path: "/templates/{name}/instances", summary: "List the groups rendered from a template.", response: []TemplateInstance{}},
+	{id: "instantiateTemplate", method: http.MethodPost, path: "/templates/{name}/instantiate", summary: "Render a template into a rule group and write it.", query: []string{"dryRun"}, request: InstantiateRequest{}, responseType: "text/plain"},
+	{id: "listSLOs", method: http.MethodGet, path: "/slos", summary: "List the SLOs.", response: []SLO{}},
+	{id: "getSLO", method: http.MethodGet, path: "/slos/{name}", summary: "Get an SLO.", response: SLO{}},
+	{id: "putSLO", method: http.MethodPut, path: "/slos/{name}", summary: "Create or update an SLO, generating its burn rate rules into the group slo-{name}.", query: []string{"dryRun"}, request: SLO{}, responseType: "text/plain"},
+	{id: "deleteSLO", method: http.MethodDelete, path: "/slos/{name}", summary: "Delete an SLO and its generated group.", query: []string{"dryRun"}, responseType: "text/plain"},
+	{id: "history", method: http.MethodGet, path: "/history", summary: "List the recent changes, newest first.", query: []string{"limit"}, response: []WatchEvent{}},
+	{id: "rollback", method: http.MethodPost, path: "/history/{revision}/rollback", summary: "Restore the rule groups as they were after a recent revision.", query: []string{"dryRun"}, responseType: "text/plain"},
+	{id: "exportRules", method: http.MethodGet, path: "/export", summary: "Export the rule groups as YAML, JSON or a tar archive.", query: []string{"format"}, responseType: "application/yaml"},
+	{id: "importRules", method: http.MethodPost, path: "/import", summary: "Import rule files.", query: []string{"strategy", "confirm"}, requestType: "application/yaml", responseType: "text/plain"},
+	{id: "buildInfo", method: http.MethodGet, path: "/status/buildinfo", summary: "Build information.", response: BuildInfo{}},
+	{id: "runtimeInfo", method: http.MethodGet, path: "/status/runtime", summary: "Runtime information.", response: RuntimeInfo{}},
+	{id: "shardStatus", method: http.MethodGet, path: "/status/shards", summary: "Size of the ConfigMap shards.", response: []ShardStatus{}},
+	{id: "leaderStatus", method: http.MethodGet, path: "/status/leader", summary: "Leader election status.", response: LeaderStatus{}},
+	{id: "gitStatus", method: http.MethodGet, path: "/git/status", summary: "Status of the Git sync.", response: GitSyncStatus{}},
+	{id: "driftStatus", method: http.MethodGet, path: "/drift", summary: "Drift of the ConfigMaps from the written rules.", response: DriftStatus{}},
+}
+
+var (
+	openAPIOnce sync.Once
+	openAPIDoc  map[string]interface{}
+)
+
+// openAPI returns the OpenAPI 3 document of the v1 API.
+func openAPI() map[string]interface{} {
+	openAPIOnce.Do(func() {
+		g := &schemaGenerator{schemas: map[string]interface{}{}}
+		paths := map[string]interface{}{}
+		for _, op := range apiOperations {
+			item, ok := paths[apiV1Prefix+op.path].(map[string]interface{})
+			if !ok {
+				item = map[string]interface{}{}
+				paths[apiV1Prefix+op.path] = item
+			}
+			item[strings.ToLower(op.method)] = g.operation(op)
+		}
+		openAPIDoc = map[string]interface{}{
+			"openapi": "3.0.3",
+			"info": map[string]interface{}{
+				"title":   "Prometheus Rules Manager",
+				"version": "v1",
+			},
+			"paths":      paths,
+			"components": map[string]interface{}{"schemas": g.schemas},
+		}
+	})
+	return openAPIDoc
+}
+
+// schemaGenerator generates JSON schemas from Go types. Named structs are
+// added to the component schemas and referenced.
+type schemaGenerator struct {
+	schemas map[string]interface{}
+}
+
+func (g *schemaGenerator) operation(op apiOperation) map[string]interface{} {
+	var params []interface{}
+	for _, m := range pathParam.FindAllStringSubmatch(op.path, -1) {
+		params = append(params, map[string]interface{}{
+			"name":     m[1],
+			"in":       "path",
+			"required": true,
+			"schema":   map[string]interface{}{"type": "string"},
+		})
+	}
+	for _, name := range op.query {
+		params = append(params, map[string]interface{}{
+			"name":   name,
+			"in":     "query",
+			"schema": map[string]interface{}{"type": "string"},
+		})
+	}
+
+	o := map[string]interface{}{
+		"operationId": op.id,
+		"summary":     op.summary,
+		"responses": map[string]interface{}{
+			"200": map[string]interface{}{
+				"description": "Success. Writes with dryRun=true answer with the diff they would make instead.",
+				"content":     g.content(op.response, op.responseType),
+			},
+			"default": map[string]interface{}{
+				"description": "Error.",
+				"content":     g.content(nil, "text/plain"),
+			},
+		},
+	}
+	if params != nil {
+		o["parameters"] = params
+	}
+	if op.request != nil || op.requestType != "" {
+		o["requestBody"] = map[string]interface{}{
+			"required": true,
+			"content":  g.content(op.request, op.requestType),
+		}
+	}
+	return o
+}
+
+func (g *schemaGenerator) content(body interface{}, mediaType string) map[string]interface{} {
+	if body == nil {
+		return map[string]interface{}{mediaType: map[string]interface{}{"schema": map[string]interface{}{"type": "string"}}}
+	}
+	return map[string]interface{}{"application/json": map[string]interface{}{"schema": g.schema(reflect.TypeOf(body))}}
+}
+
+func (g *schemaGenerator) schema(t reflect.Type) map[string]interface{} {
+	switch t {
+	case durationType:
+		return map[string]interface{}{"type": "string", "pattern": durationPattern}
+	case timeType:
+		return map[string]interface{}{"type": "string", "format": "date-time"}
+	}
+	switch t.Kind() {
+	case reflect.Ptr:
+		return g.schema(t.Elem())
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.Slice, reflect.Array:
+		return map[string]interface{}{"type": "array", "items": g.schema(t.Elem())}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": g.schema(t.Elem())}
+	case reflect.Struct:
+		if _, ok := g.schemas[t.Name()]; !ok {
+			// Reserve the name first, the struct may refer to itself.
+			g.schemas[t.Name()] = nil
+			g.schemas[t.Name()] = g.object(t)
+		}
+		return map[string]interface{}{"$ref": "#/components/schemas/" + t.Name()}
+	default:
+		return map[string]interface{}{}
+	}
+}
+
+// object returns the schema of a struct. Unknown properties are rejected,
+// like decodeJSON does.
+func (g *schemaGenerator) object(t reflect.Type) map[string]interface{} {
+	properties := map[string]interface{}{}
+	var required []string
+	g.fields(t, properties, &required)
+	s := map[string]interface{}{
+		"type":                 "object",
+		"properties":           properties,
+		"additionalProperties": false,
+	}
+	if len(required) > 0 {
+		s["required"] = required
+	}
+	return s
+}
+
+func (g *schemaGenerator) fields(t reflect.Type, properties map[string]interface{}, required *[]string) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if !f.IsExported() && !f.Anonymous {
+			continue
+		}
+		tag := f.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name, opts, _ := strings.Cut(tag, ",")
+		if f.Anonymous && name == "" && f.Type.Kind() == reflect.Struct {
+			// Embedded fields are promoted like encoding/json does.
+			g.fields(f.Type, properties, required)
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		properties[name] = g.schema(f.Type)
+		if !strings.Contains(opts, "omitempty") {
+			*required = append(*required, name)
+		}
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/go-kit/log"
+	"github.com/prometheus/common/route"
+)
+
+// TestAPIOperations checks that every route served under apiV1Prefix is
+// described by an operation of the OpenAPI document, and the other way round.
+func TestAPIOperations(t *testing.T) {
+	paths := map[string]struct{}{}
+	router := route.New().WithInstrumentation(func(path string, f http.HandlerFunc) http.HandlerFunc {
+		// The document does not describe itself.
+		if strings.HasPrefix(path, apiV1Prefix+"/") && path != apiV1Prefix+"/openapi.json" {
+			paths[path] = struct{}{}
+		}
+		return f
+	})
+	h := &Handler{logger: log.NewNopLogger(), options: &Options{}}
+	h.registerRoutes(router)
+
+	documented := map[string]bool{}
+	for _, op := range apiOperations {
+		documented[op.method+" "+op.path] = false
+	}
+	param := regexp.MustCompile(`:(\w+)`)
+	for path := range paths {
+		// The router answers OPTIONS with the methods the path is served
+		// with.
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodOptions, path, nil))
+		for _, method := range strings.Split(w.Header().Get("Allow"), ", ") {
+			if method == http.MethodOptions {
+				continue
+			}
+			key := method + " " + param.ReplaceAllString(strings.TrimPrefix(path, apiV1Prefix), "{$1}")
+			if _, ok := documented[key]; !ok {
+				t.Errorf("route %s has no API operation", key)
+				continue
+			}
+			documented[key] = true
+		}
+	}
+	for key, routed := range documented {
+		if !routed {
+			t.Errorf("API operation %s is not routed", key)
+		}
+	}
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/alecthomas/kingpin"
+	"github.com/mwitkow/go-conntrack"
+	"github.com/prometheus/client_golang/api"
+	v1 "github.com/prometheus/client_golang/api/prometheus/v1"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/promql"
+	"github.com/prometheus/prometheus/promql/parser"
+)
+
+// seriesLookback is how far back selectors are looked up in the series API.
+const seriesLookback = time.Hour
+
+var (
+	prometheusURL        = kingpin.Flag("prometheus.url", "URL of the Prometheus server used to check expressions before saving. Live checks are disabled if empty.").Default("").String()
+	checkTimeout         = kingpin.Flag("prometheus.check.timeout", "Timeout for the live checks of a single expression.").Default("10s").Duration()
+	checkMaxCardinality  = kingpin.Flag("prometheus.check.max-cardinality", "Warn when an expression returns more series than this. 0 disables the check.").Default("10000").Int()
+	checkMaxRecordSeries = kingpin.Flag("prometheus.check.max-recording-series", "Warn when a recording rule would create more series than this. 0 disables the check.").Default("1000").Int()
+)
+
+// ExprChecker runs expressions against a live Prometheus server to catch
+// mistakes that parse fine, like misspelled metric or label names.
+type ExprChecker struct {
+	api                v1.API
+	timeout            time.Duration
+	maxCardinality     int
+	maxRecordingSeries int
+}
+
+// NewExprChecker returns a checker querying the Prometheus server at url.
+func NewExprChecker(url string, timeout time.Duration, maxCardinality, maxRecordingSeries int) (*ExprChecker, error) {
+	client, err := api.NewClient(api.Config{
+		Address: url,
+		RoundTripper: &http.Transport{
+			Proxy:               http.ProxyFromEnvironment,
+			DialContext:         conntrack.NewDialContextFunc(conntrack.DialWithName("prometheus"), conntrack.DialWithTracing()),
+			TLSHandshakeTimeout: 10 * time.Second,
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &ExprChecker{
+		api:                v1.NewAPI(client),
+		timeout:            timeout,
+		maxCardinality:     maxCardinality,
+		maxRecordingSeries: maxRecordingSeries,
+	}, nil
+}
+
+// Check returns the warnings for a single rule. Rules whose expression does
+// not parse are left to RuleNode.Validate.
+func (c *ExprChecker) Check(ctx context.Context, rule Rule) (warnings []string) {
+	expr, err := parser.ParseExpr(rule.Expr)
+	if err != nil {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+
+	now := time.Now()
+	for _, vs := range selectors(expr) {
+		series, _, err := c.api.Series(ctx, []string{vs}, now.Add(-seriesLookback), now)
+		if err != nil {
+			warnings = append(warnings, fmt.Sprintf("%s: could not look up series for %s: %v", ruleName(rule), vs, err))
+			continue
+		}
+		if len(series) == 0 {
+			warnings = append(warnings, fmt.Sprintf("%s: selector %s matches no series", ruleName(rule), vs))
+		}
+	}
+
+	val, _, err := c.api.Query(ctx, rule.Expr, now)
+	if err != nil {
+		warnings = append(warnings, fmt.Sprintf("%s: could not evaluate expression: %v", ruleName(rule), err))
+		return warnings
+	}
+	cardinality := 1
+	switch v := val.(type) {
+	case model.Vector:
+		cardinality = len(v)
+	case model.Matrix:
+		cardinality = len(v)
+	}
+	if c.maxCardinality > 0 && cardinality > c.maxCardinality {
+		warnings = append(warnings, fmt.Sprintf("%s: expression returns %d series, more than the budget of %d", ruleName(rule), cardinality, c.maxCardinality))
+	}
+	if rule.Record != "" && c.maxRecordingSeries > 0 && cardinality > c.maxRecordingSeries {
+		warnings = append(warnings, fmt.Sprintf("%s: recording rule would create %d series, more than the limit of %d", ruleName(rule), cardinality, c.maxRecordingSeries))
+	}
+	return warnings
+}
+
+// Query evaluates an instant query and returns the result as a PromQL vector.
+// It can be used as a template.QueryFunc.
+func (c *ExprChecker) Query(ctx context.Context, q string, ts time.Time) (promql.Vector, error) {
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+
+	val, _, err := c.api.Query(ctx, q, ts)
+	if err != nil {
+		return nil, err
+	}
+	switch v := val.(type) {
+	case model.Vector:
+		vec := make(promql.Vector, 0, len(v))
+		for _, s := range v {
+			vec = append(vec, promql.Sample{
+				T:      int64(s.Timestamp),
+				F:      float64(s.Value),
+				Metric: modelToLabels(s.Metric),
+			})
+		}
+		return vec, nil
+	case *model.Scalar:
+		return promql.Vector{{T: int64(v.Timestamp), F: float64(v.Value)}}, nil
+	default:
+		return nil, fmt.Errorf("query %q returned %s, expected a vector", q, val.Type())
+	}
+}
+
+// modelToLabels converts a model.Metric into labels.Labels.
+func modelToLabels(m model.Metric) labels.Labels {
+	lbls := make(map[string]string, len(m))
+	for k, v := range m {
+		lbls[string(k)] = string(v)
+	}
+	return labels.FromMap(lbls)
+}
+
+// CheckGroup checks the rules of newRuleGroup whose expression is new or
+// changed compared to the current rule set.
+func (c *ExprChecker) CheckGroup(ctx context.Context, current *RuleGroups, newRuleGroup SimpleRuleGroup) (warnings []string) {
+	for _, rule := range newRuleGroup.Rules {
+		if current.hasRule(newRuleGroup.Name, rule) {
+			continue
+		}
+		warnings = append(warnings, c.Check(ctx, rule)...)
+	}
+	return warnings
+}
+
+// selectors returns the distinct series selectors used in expr, stripped of
+// offsets and @ modifiers so they can be passed to the series API.
+func selectors(expr parser.Expr) []string {
+	var (
+		seen = map[string]struct{}{}
+		sels []string
+	)
+	parser.Inspect(expr, func(node parser.Node, _ []parser.Node) error {
+		vs, ok := node.(*parser.VectorSelector)
+		if !ok {
+			return nil
+		}
+		s := (&parser.VectorSelector{Name: vs.Name, LabelMatchers: vs.LabelMatchers}).String()
+		if _, ok := seen[s]; !ok {
+			seen[s] = struct{}{}
+			sels = append(sels, s)
+		}
+		return nil
+	})
+	return sels
+}
+
+// hasRule reports whether the group already holds rule with the same name
+// and expression.
+func (g *RuleGroups) hasRule(group string, rule Rule) bool {
+	if g == nil {
+		return false
+	}
+	for _, ruleGroup := range g.Groups {
+		if ruleGroup.Name != group {
+			continue
+		}
+		for _, existingRule := range ruleGroup.Rules {
+			if existingRule.Alert.Value == rule.Alert && existingRule.Record.Value == rule.Record && existingRule.Expr.Value == rule.Expr {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// ruleName returns the alert or record name of rule.
+func ruleName(rule Rule) string {
+	if rule.Alert != "" {
+		return rule.Alert
+	}
+	return rule.Record
+}
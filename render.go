@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/alecthomas/kingpin"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/model/timestamp"
+	"github.com/prometheus/prometheus/promql"
+	"github.com/prometheus/prometheus/template"
+)
+
+// maxRenderedAlerts caps how many alerts are rendered from fetched samples.
+const maxRenderedAlerts = 20
+
+var (
+	alertExternalURL    = kingpin.Flag("alert.external-url", "External URL exposed to alert templates as $externalURL.").Default("").String()
+	alertExternalLabels = kingpin.Flag("alert.external-label", "External label exposed to alert templates as $externalLabels, as name=value. May be repeated.").StringMap()
+)
+
+// RenderRequest is the body of a rule rendering request. Without Fetch the
+// rule is rendered once with the sample Labels and Value.
+type RenderRequest struct {
+	Rule   Rule              `json:"rule"`
+	Labels map[string]string `json:"labels,omitempty"`
+	Value  float64           `json:"value,omitempty"`
+	// Fetch evaluates the rule expression against the configured Prometheus
+	// server and renders one alert per returned sample instead.
+	Fetch bool `json:"fetch,omitempty"`
+}
+
+// RenderedAlert is an alert with fully expanded labels and annotations.
+type RenderedAlert struct {
+	Labels      map[string]string `json:"labels"`
+	Annotations map[string]string `json:"annotations"`
+	Value       float64           `json:"value"`
+}
+
+// AlertRenderer expands alerting rule templates the way Prometheus does when
+// the alert fires.
+type AlertRenderer struct {
+	externalLabels map[string]string
+	externalURL    string
+	// query answers the query template function and fetches samples. It is
+	// nil when no Prometheus server is configured.
+	query template.QueryFunc
+}
+
+// NewAlertRenderer returns a renderer exposing externalLabels and externalURL
+// to the templates. checker may be nil.
+func NewAlertRenderer(externalLabels map[string]string, externalURL string, checker *ExprChecker) *AlertRenderer {
+	r := &AlertRenderer{
+		externalLabels: externalLabels,
+		externalURL:    externalURL,
+	}
+	if checker != nil {
+		r.query = checker.Query
+	}
+	return r
+}
+
+// Render expands the templates of the requested alerting rule.
+func (r *AlertRenderer) Render(ctx context.Context, req RenderRequest) ([]RenderedAlert, error) {
+	if req.Rule.Alert == "" {
+		return nil, errors.New("only alerting rules can be rendered")
+	}
+
+	ts := time.Now()
+	samples := promql.Vector{{
+		T:      timestamp.FromTime(ts),
+		F:      req.Value,
+		Metric: labels.FromMap(req.Labels),
+	}}
+	if req.Fetch {
+		if r.query == nil {
+			return nil, errors.New("no Prometheus server configured to fetch samples from")
+		}
+		var err error
+		samples, err = r.query(ctx, req.Rule.Expr, ts)
+		if err != nil {
+			return nil, fmt.Errorf("could not evaluate expression: %w", err)
+		}
+		if len(samples) > maxRenderedAlerts {
+			samples = samples[:maxRenderedAlerts]
+		}
+	}
+
+	query := r.query
+	if query == nil {
+		query = func(context.Context, string, time.Time) (promql.Vector, error) {
+			return nil, errors.New("no Prometheus server configured")
+		}
+	}
+
+	var externalURL *url.URL
+	if r.externalURL != "" {
+		var err error
+		externalURL, err = url.Parse(r.externalURL)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	alerts := make([]RenderedAlert, 0, len(samples))
+	for _, smpl := range samples {
+		tmplData := template.AlertTemplateData(smpl.Metric.Map(), r.externalLabels, r.externalURL, smpl.F)
+		defs := []string{
+			"{{$labels := .Labels}}",
+			"{{$externalLabels := .ExternalLabels}}",
+			"{{$externalURL := .ExternalURL}}",
+			"{{$value := .Value}}",
+		}
+		expand := func(text string) string {
+			tmpl := template.NewTemplateExpander(
+				ctx,
+				strings.Join(append(defs, text), ""),
+				"__alert_"+req.Rule.Alert,
+				tmplData,
+				model.Time(timestamp.FromTime(ts)),
+				query,
+				externalURL,
+				nil,
+			)
+			result, err := tmpl.Expand()
+			if err != nil {
+				result = fmt.Sprintf("<error expanding template: %s>", err)
+			}
+			return result
+		}
+
+		lb := labels.NewBuilder(smpl.Metric).Del(labels.MetricName)
+		for k, v := range req.Rule.Labels {
+			lb.Set(k, expand(v))
+		}
+		lb.Set(labels.AlertName, req.Rule.Alert)
+
+		annotations := make(map[string]string, len(req.Rule.Annotations))
+		for k, v := range req.Rule.Annotations {
+			annotations[k] = expand(v)
+		}
+
+		alerts = append(alerts, RenderedAlert{
+			Labels:      lb.Labels().Map(),
+			Annotations: annotations,
+			Value:       smpl.F,
+		})
+	}
+	return alerts, nil
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"strings"
+
+	"github.com/alecthomas/kingpin"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	// maxConfigMapSize is the size limit Kubernetes enforces on ConfigMaps.
+	maxConfigMapSize = 1 << 20
+	// shardNearFull is the size above which groups are moved off a shard.
+	shardNearFull = maxConfigMapSize * 9 / 10
+	// maxAnnotationsSize is the limit Kubernetes enforces on the total size of
+	// the annotations of an object.
+	maxAnnotationsSize = 256 << 10
+)
+
+var configMapShards = kingpin.Flag("configmap.shards", "Number of ConfigMaps to spread rule groups over, named <configmap>-<n> with key rules-<n>.yml. 0 keeps all rules in a single ConfigMap. Groups left on the ConfigMaps of another shard count are moved to the configured ones.").Default("0").Int()
+
+// errRuleFileTooLarge is returned when the rule groups do not fit in the
+// configured ConfigMaps.
+var errRuleFileTooLarge = errors.New("rule file exceeds the ConfigMap size limit")
+
+// shard is a ConfigMap holding a part of the rule groups.
+type shard struct {
+	configMap       string
+	key             string
+	resourceVersion string
+	// missing is set if the ConfigMap did not exist on the last load.
+	missing bool
+	// content is the rule file as last read or written.
+	content string
+	// annotations are the ConfigMap's annotations as last read or written.
+	annotations map[string]string
+	// retired is set for ConfigMaps which are not among the configured
+	// shards but still exist, like the unsharded ConfigMap after sharding is
+	// enabled. Their groups are moved to the configured shards.
+	retired bool
+}
+
+// ShardStatus describes the size headroom of a shard.
+type ShardStatus struct {
+	ConfigMap     string `json:"configMap"`
+	Key           string `json:"key"`
+	Groups        int    `json:"groups"`
+	SizeBytes     int    `json:"sizeBytes"`
+	LimitBytes    int    `json:"limitBytes"`
+	HeadroomBytes int    `json:"headroomBytes"`
+	// Retired is set for ConfigMaps the groups are being moved off.
+	Retired bool `json:"retired,omitempty"`
+}
+
+// newShards returns the configured shards, a single one holding rulefileName
+// unless sharding is enabled.
+func newShards() []*shard {
+	if *configMapShards <= 0 {
+		return []*shard{unshardedShard()}
+	}
+	shards := make([]*shard, 0, *configMapShards)
+	for i := 0; i < *configMapShards; i++ {
+		shards = append(shards, numberedShard(i))
+	}
+	return shards
+}
+
+// unshardedShard returns the shard holding all rule groups when sharding is
+// disabled.
+func unshardedShard() *shard {
+	return &shard{configMap: rulefileConfigMap, key: rulefileName}
+}
+
+// numberedShard returns the i-th shard when sharding is enabled.
+func numberedShard(i int) *shard {
+	ext := ".yml"
+	base := strings.TrimSuffix(rulefileName, ext)
+	return &shard{
+		configMap: fmt.Sprintf("%s-%d", rulefileConfigMap, i),
+		key:       fmt.Sprintf("%s-%d%s", base, i, ext),
+	}
+}
+
+// annotationsSize returns the number of bytes annotations take in a
+// ConfigMap.
+func annotationsSize(annotations map[string]string) int {
+	size := 0
+	for k, v := range annotations {
+		size += len(k) + len(v)
+	}
+	return size
+}
+
+// size returns the number of bytes content and annotations take in the
+// shard's ConfigMap.
+func (s *shard) size(content string, annotations map[string]string) int {
+	return len(s.key) + len(content) + annotationsSize(annotations)
+}
+
+// configured returns the number of configured shards, the retired ones
+// follow them.
+func (manager *RulesManager) configured() int {
+	n := 0
+	for _, s := range manager.shards {
+		if !s.retired {
+			n++
+		}
+	}
+	return n
+}
+
+// shardAnnotations returns the annotations the i-th shard is written with,
+// besides the checksum: the ones of the manager for the first shard and the
+// ones not kept by the manager for all.
+func (manager *RulesManager) shardAnnotations(i int) map[string]string {
+	s := manager.shards[i]
+	annotations := map[string]string{}
+	for k, v := range s.annotations {
+		if !strings.HasPrefix(k, annotationPrefix) {
+			annotations[k] = v
+		}
+	}
+	if i == 0 {
+		for k, v := range manager.annotations {
+			annotations[k] = v
+		}
+	}
+	return annotations
+}
+
+// shardOf returns the shard a new group is assigned to.
+func shardOf(group string, shards int) int {
+	h := fnv.New32a()
+	h.Write([]byte(group))
+	return int(h.Sum32() % uint32(shards))
+}
+
+// shardContents returns the rule file of every shard. Groups stay on the
+// shard they were read from and new groups go to the shard picked by hashing
+// their name, so that assignments are stable. Groups are moved off shards
+// filled above shardNearFull to the emptiest shard.
+func (manager *RulesManager) shardContents() ([]string, error) {
+	var (
+		n          = manager.configured()
+		groups     = make([][]RuleGroup, len(manager.shards))
+		sizes      = make([]int, n)
+		groupSizes = map[string]int{}
+		limit      = shardNearFull
+	)
+	// The manager's state is kept in the annotations of the first shard.
+	sizes[0] = annotationsSize(manager.shardAnnotations(0)) + len(checksumAnnotation) + 64
+	emptiest := func() int {
+		e := 0
+		for i := range sizes {
+			if sizes[i] < sizes[e] {
+				e = i
+			}
+		}
+		return e
+	}
+
+	for _, g := range manager.ruleGroups.Groups {
+		b, err := yaml.Marshal(&RuleGroups{Groups: []RuleGroup{g}})
+		if err != nil {
+			return nil, err
+		}
+		groupSizes[g.Name] = len(b)
+
+		i, ok := manager.groupShards[g.Name]
+		if !ok || i >= n {
+			i = shardOf(g.Name, n)
+			if sizes[i]+len(b) > limit {
+				i = emptiest()
+			}
+		}
+		groups[i] = append(groups[i], g)
+		sizes[i] += len(b)
+	}
+
+	// Rebalance shards which are near full.
+	for i := 0; i < n; i++ {
+		for sizes[i] > limit {
+			target := emptiest()
+			largest := 0
+			for j, g := range groups[i] {
+				if groupSizes[g.Name] > groupSizes[groups[i][largest].Name] {
+					largest = j
+				}
+			}
+			g := groups[i][largest]
+			if target == i || sizes[target]+groupSizes[g.Name] > limit {
+				break
+			}
+			groups[i] = append(groups[i][:largest], groups[i][largest+1:]...)
+			groups[target] = append(groups[target], g)
+			sizes[i] -= groupSizes[g.Name]
+			sizes[target] += groupSizes[g.Name]
+		}
+	}
+
+	contents := make([]string, len(manager.shards))
+	groupShards := make(map[string]int, len(groupSizes))
+	for i, s := range manager.shards {
+		if groups[i] == nil {
+			groups[i] = []RuleGroup{}
+		}
+		b, err := yaml.Marshal(&RuleGroups{Groups: groups[i]})
+		if err != nil {
+			return nil, err
+		}
+		annotations := manager.shardAnnotations(i)
+		if size := annotationsSize(annotations); size > maxAnnotationsSize {
+			return nil, fmt.Errorf("%w: annotations of %s/%s would be %d bytes", errRuleFileTooLarge, namespace, s.configMap, size)
+		}
+		if size := s.size(string(b), annotations); size > maxConfigMapSize {
+			return nil, fmt.Errorf("%w: %s/%s would be %d bytes", errRuleFileTooLarge, namespace, s.configMap, size)
+		}
+		contents[i] = string(b)
+		for _, g := range groups[i] {
+			groupShards[g.Name] = i
+		}
+	}
+	manager.groupShards = groupShards
+	return contents, nil
+}
+
+// shardStatus returns the size headroom of every shard.
+func (manager *RulesManager) shardStatus() []ShardStatus {
+	status := make([]ShardStatus, 0, len(manager.shards))
+	for i, s := range manager.shards {
+		groups := 0
+		for _, j := range manager.groupShards {
+			if j == i {
+				groups++
+			}
+		}
+		size := s.size(s.content, s.annotations)
+		status = append(status, ShardStatus{
+			ConfigMap:     s.configMap,
+			Key:           s.key,
+			Groups:        groups,
+			SizeBytes:     size,
+			LimitBytes:    maxConfigMapSize,
+			HeadroomBytes: maxConfigMapSize - size,
+			Retired:       s.retired,
+		})
+	}
+	return status
+}
+
+// migrateShards moves the groups and the state left on retired shards, if
+// any, to the configured shards through queue.
+func migrateShards(ctx context.Context, queue *WriteQueue) error {
+	manager, err := NewRulesManager()
+	if err != nil {
+		return err
+	}
+	if manager.configured() == len(manager.shards) {
+		return nil
+	}
+	// Every write moves the groups to the configured shards.
+	return queue.Submit(ctx, "shard-migration", writeOp{
+		description: "Move rule groups to the configured shards",
+		mutate:      func(*RulesManager) error { return nil },
+	})
+}
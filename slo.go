@@ -0,0 +1,458 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"text/template"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/common/route"
+	"github.com/prometheus/prometheus/promql/parser"
+	"golang.org/x/exp/slices"
+)
+
+const (
+	// slosAnnotation stores the SLOs, as a JSON object mapping SLO names to
+	// SLOs.
+	slosAnnotation = annotationPrefix + "slos"
+	// sloGroupPrefix prefixes the names of the groups generated from SLOs.
+	sloGroupPrefix = "slo-"
+	// sloAlert is the name of the burn rate alerts.
+	sloAlert = "SLOErrorBudgetBurn"
+)
+
+// sloWindows are the windows the error ratio of an SLI is recorded for.
+var sloWindows = []model.Duration{
+	model.Duration(5 * time.Minute),
+	model.Duration(30 * time.Minute),
+	model.Duration(time.Hour),
+	model.Duration(2 * time.Hour),
+	model.Duration(6 * time.Hour),
+	model.Duration(24 * time.Hour),
+	model.Duration(72 * time.Hour),
+}
+
+// burnRateAlert is a multi-window burn rate condition: the alert fires when
+// both the long and the short window burn the given fraction of the error
+// budget of the SLO window.
+type burnRateAlert struct {
+	severity    string
+	long, short model.Duration
+	budget      float64
+}
+
+// burnRateAlerts are the conditions recommended by the Google SRE workbook.
+var burnRateAlerts = []burnRateAlert{
+	{severity: "page", long: model.Duration(time.Hour), short: model.Duration(5 * time.Minute), budget: 0.02},
+	{severity: "page", long: model.Duration(6 * time.Hour), short: model.Duration(30 * time.Minute), budget: 0.05},
+	{severity: "ticket", long: model.Duration(24 * time.Hour), short: model.Duration(2 * time.Hour), budget: 0.1},
+	{severity: "ticket", long: model.Duration(72 * time.Hour), short: model.Duration(6 * time.Hour), budget: 0.1},
+}
+
+var sloNameRE = regexp.MustCompile(`^[a-zA-Z0-9_-]+$`)
+
+var (
+	errSLONotFound = errors.New("SLO not found")
+	// errSLOInvalid is returned for SLOs which are not valid.
+	errSLOInvalid = errors.New("invalid SLO")
+	// errGeneratedGroup is returned for writes changing a group generated
+	// from an SLO by other means than changing the SLO.
+	errGeneratedGroup = errors.New("group is generated from an SLO")
+)
+
+// SLO is a service level objective the burn rate rules are generated from.
+type SLO struct {
+	Name        string `json:"name"`
+	Service     string `json:"service"`
+	Description string `json:"description,omitempty"`
+	SLI         SLI    `json:"sli"`
+	// Objective is the ratio of good events to achieve, like 0.999.
+	Objective float64 `json:"objective"`
+	// Window is the period the objective is measured over, 30d by default.
+	Window model.Duration `json:"window,omitempty"`
+	// Labels are added to the alerts, they cannot override the slo, service
+	// and severity labels.
+	Labels map[string]string `json:"labels,omitempty"`
+}
+
+// SLI is the indicator of an SLO, either as queries for the good and the
+// total events or as a query for the ratio of bad events. The queries use
+// {{.window}} as the range of their range selectors.
+type SLI struct {
+	Good       string `json:"good,omitempty"`
+	Total      string `json:"total,omitempty"`
+	ErrorRatio string `json:"errorRatio,omitempty"`
+}
+
+// groupName returns the name of the group generated from the SLO.
+func (s SLO) groupName() string {
+	return sloGroupPrefix + s.Name
+}
+
+// window returns the period the objective is measured over.
+func (s SLO) window() model.Duration {
+	if s.Window == 0 {
+		return model.Duration(30 * 24 * time.Hour)
+	}
+	return s.Window
+}
+
+// errorRatio returns the expression of the ratio of bad events over window.
+func (s SLO) errorRatio(window model.Duration) (string, error) {
+	query := s.SLI.ErrorRatio
+	if query == "" {
+		query = "1 - ((" + s.SLI.Good + ") / (" + s.SLI.Total + "))"
+	}
+	expr, err := s.sliQuery(query, window)
+	if err != nil {
+		return "", err
+	}
+	if _, err := parser.ParseExpr(expr); err != nil {
+		return "", fmt.Errorf("%w: SLI query for window %s: %s", errSLOInvalid, window, err)
+	}
+	return expr, nil
+}
+
+// sliQuery renders an SLI query for window.
+func (s SLO) sliQuery(query string, window model.Duration) (string, error) {
+	tmpl, err := template.New(s.Name).Option("missingkey=error").Parse(query)
+	if err != nil {
+		return "", fmt.Errorf("%w: %s", errSLOInvalid, err)
+	}
+	var b bytes.Buffer
+	if err := tmpl.Execute(&b, map[string]string{"window": window.String()}); err != nil {
+		return "", fmt.Errorf("%w: %s", errSLOInvalid, err)
+	}
+	return b.String(), nil
+}
+
+// validate checks the SLO.
+func (s SLO) validate() error {
+	switch {
+	case !sloNameRE.MatchString(s.Name):
+		return fmt.Errorf("%w: invalid name %q", errSLOInvalid, s.Name)
+	case s.Service == "":
+		return fmt.Errorf("%w: service is empty", errSLOInvalid)
+	case s.Objective <= 0 || s.Objective >= 1:
+		return fmt.Errorf("%w: objective must be between 0 and 1, got %v", errSLOInvalid, s.Objective)
+	case s.window() < sloWindows[len(sloWindows)-1]:
+		return fmt.Errorf("%w: window must be at least %s", errSLOInvalid, sloWindows[len(sloWindows)-1])
+	case s.SLI.ErrorRatio != "" && (s.SLI.Good != "" || s.SLI.Total != ""):
+		return fmt.Errorf("%w: SLI has both an error ratio and good and total queries", errSLOInvalid)
+	case s.SLI.ErrorRatio == "" && (s.SLI.Good == "" || s.SLI.Total == ""):
+		return fmt.Errorf("%w: SLI needs an error ratio or good and total queries", errSLOInvalid)
+	}
+	for _, query := range []string{s.SLI.Good, s.SLI.Total, s.SLI.ErrorRatio} {
+		if query == "" {
+			continue
+		}
+		// A query rendering the same for all windows would record the
+		// same ratio for all of them.
+		short, err := s.sliQuery(query, sloWindows[0])
+		if err != nil {
+			return err
+		}
+		long, err := s.sliQuery(query, sloWindows[len(sloWindows)-1])
+		if err != nil {
+			return err
+		}
+		if short == long {
+			return fmt.Errorf("%w: SLI query %q does not use {{.window}}", errSLOInvalid, query)
+		}
+	}
+	for name := range s.Labels {
+		if !model.LabelName(name).IsValid() {
+			return fmt.Errorf("%w: invalid label name %q", errSLOInvalid, name)
+		}
+	}
+	return nil
+}
+
+// generate returns the group of the recording rules of the SLI error ratio
+// over all windows and the multi-window multi-burn-rate alerts.
+func (s SLO) generate() (SimpleRuleGroup, error) {
+	group := SimpleRuleGroup{Name: s.groupName()}
+	if err := s.validate(); err != nil {
+		return group, err
+	}
+	selector := fmt.Sprintf("{slo=%q}", s.Name)
+	sloLabels := func() map[string]string {
+		return map[string]string{"slo": s.Name, "service": s.Service}
+	}
+
+	for _, window := range sloWindows {
+		expr, err := s.errorRatio(window)
+		if err != nil {
+			return group, err
+		}
+		group.Rules = append(group.Rules, Rule{
+			Record: "slo:sli_error:ratio_rate" + window.String(),
+			Expr:   expr,
+			Labels: sloLabels(),
+		})
+	}
+	objective := strconv.FormatFloat(s.Objective, 'g', -1, 64)
+	group.Rules = append(group.Rules, Rule{
+		Record: "slo:objective:ratio",
+		Expr:   "vector(" + objective + ")",
+		Labels: sloLabels(),
+	})
+
+	for _, severity := range []string{"page", "ticket"} {
+		var expr string
+		for _, a := range burnRateAlerts {
+			if a.severity != severity {
+				continue
+			}
+			factor := strconv.FormatFloat(a.budget*float64(s.window())/float64(a.long), 'g', 6, 64)
+			threshold := fmt.Sprintf("(%s * (1 - %s))", factor, objective)
+			if expr != "" {
+				expr += "\nor\n"
+			}
+			expr += fmt.Sprintf("(\n  slo:sli_error:ratio_rate%s%s > %s\nand\n  slo:sli_error:ratio_rate%s%s > %s\n)",
+				a.long, selector, threshold, a.short, selector, threshold)
+		}
+		labels := map[string]string{}
+		for k, v := range s.Labels {
+			labels[k] = v
+		}
+		for k, v := range sloLabels() {
+			labels[k] = v
+		}
+		labels["severity"] = severity
+		group.Rules = append(group.Rules, Rule{
+			Alert:  sloAlert,
+			Expr:   expr,
+			Labels: labels,
+			Annotations: map[string]string{
+				"summary":     fmt.Sprintf("Service %s is burning its error budget too fast.", s.Service),
+				"description": fmt.Sprintf("SLO %s of %s over %s is at risk of being missed.", s.Name, objective, s.window()),
+			},
+		})
+	}
+
+	problems, err := validateGroup(group)
+	if err != nil {
+		return group, err
+	}
+	if len(problems) > 0 {
+		return group, fmt.Errorf("%w: generated group has errors: %v", errSLOInvalid, problems)
+	}
+	return group, nil
+}
+
+// slos returns the stored SLOs by name.
+func (manager *RulesManager) slos() map[string]SLO {
+	slos := map[string]SLO{}
+	if v, ok := manager.annotations[slosAnnotation]; ok {
+		// A corrupted annotation loses the SLOs, not the rules.
+		json.Unmarshal([]byte(v), &slos)
+	}
+	return slos
+}
+
+// setSLOs stores the SLOs.
+func (manager *RulesManager) setSLOs(slos map[string]SLO) {
+	if len(slos) == 0 {
+		delete(manager.annotations, slosAnnotation)
+		return
+	}
+	b, _ := json.Marshal(slos)
+	manager.annotations[slosAnnotation] = string(b)
+}
+
+// generatedGroups returns the current groups generated from SLOs by name.
+func (manager *RulesManager) generatedGroups() map[string]SimpleRuleGroup {
+	slos := manager.slos()
+	groups := make(map[string]SimpleRuleGroup, len(slos))
+	for _, slo := range slos {
+		for _, g := range manager.ruleGroups.Groups {
+			if g.Name == slo.groupName() {
+				groups[g.Name] = newSimpleRuleGroup(g)
+			}
+		}
+	}
+	return groups
+}
+
+// checkGeneratedGroups returns an error if a group generated from an SLO was
+// changed, compared to before, into something else than what the SLO
+// generates. Generated groups which drifted before are left alone.
+func (manager *RulesManager) checkGeneratedGroups(before map[string]SimpleRuleGroup) error {
+	current := map[string]SimpleRuleGroup{}
+	for _, g := range manager.ruleGroups.Groups {
+		current[g.Name] = newSimpleRuleGroup(g)
+	}
+	for _, slo := range manager.slos() {
+		want, err := slo.generate()
+		if err != nil {
+			continue
+		}
+		got, ok := current[want.Name]
+		if ok && sameGroup(got, want) {
+			continue
+		}
+		old, existed := before[want.Name]
+		if ok == existed && (!ok || reflect.DeepEqual(old, got)) {
+			continue
+		}
+		return fmt.Errorf("%w %q: %q, change the SLO instead", errGeneratedGroup, slo.Name, want.Name)
+	}
+	return nil
+}
+
+// sameGroup reports whether the groups have the same rules, comparing the
+// parsed expressions.
+func sameGroup(a, b SimpleRuleGroup) bool {
+	if a.Name != b.Name || a.Interval != b.Interval || a.Limit != b.Limit || len(a.Rules) != len(b.Rules) {
+		return false
+	}
+	for i := range a.Rules {
+		ra, rb := a.Rules[i], b.Rules[i]
+		if !sameExpr(ra.Expr, rb.Expr) {
+			return false
+		}
+		ra.Expr, rb.Expr = "", ""
+		if len(ra.Labels) == 0 {
+			ra.Labels = nil
+		}
+		if len(rb.Labels) == 0 {
+			rb.Labels = nil
+		}
+		if len(ra.Annotations) == 0 {
+			ra.Annotations = nil
+		}
+		if len(rb.Annotations) == 0 {
+			rb.Annotations = nil
+		}
+		if !reflect.DeepEqual(ra, rb) {
+			return false
+		}
+	}
+	return true
+}
+
+// putSLOOp creates or updates an SLO and generates its group again.
+func putSLOOp(slo SLO) writeOp {
+	return writeOp{
+		description: fmt.Sprintf("Put SLO %q", slo.Name),
+		mutate: func(manager *RulesManager) error {
+			group, err := slo.generate()
+			if err != nil {
+				return err
+			}
+			slos := manager.slos()
+			if _, ok := slos[slo.Name]; !ok {
+				for _, g := range manager.ruleGroups.Groups {
+					if g.Name == group.Name {
+						return fmt.Errorf("%w: group %q already exists", errSLOInvalid, group.Name)
+					}
+				}
+			}
+			slos[slo.Name] = slo
+			manager.setSLOs(slos)
+			manager.importGroups([]RuleGroup{newRuleGroupNode(manager.canonicalizeGroup(group))}, importReplaceGroups)
+			return nil
+		},
+	}
+}
+
+// deleteSLOOp deletes an SLO and its generated group.
+func deleteSLOOp(name string) writeOp {
+	return writeOp{
+		description: fmt.Sprintf("Delete SLO %q", name),
+		mutate: func(manager *RulesManager) error {
+			slos := manager.slos()
+			slo, ok := slos[name]
+			if !ok {
+				return fmt.Errorf("%w: %q", errSLONotFound, name)
+			}
+			delete(slos, name)
+			manager.setSLOs(slos)
+			if i := slices.IndexFunc(manager.ruleGroups.Groups, func(g RuleGroup) bool { return g.Name == slo.groupName() }); i >= 0 {
+				manager.ruleGroups.Groups = slices.Delete(manager.ruleGroups.Groups, i, i+1)
+			}
+			return nil
+		},
+	}
+}
+
+func (h *Handler) listSLOs(w http.ResponseWriter, r *http.Request) {
+	rulesManager, err := NewCachedRulesManager()
+	if err != nil {
+		h.writeError(w, "SLOs cannot be read", err)
+		return
+	}
+	slos := []SLO{}
+	for _, slo := range rulesManager.slos() {
+		slos = append(slos, slo)
+	}
+	sort.Slice(slos, func(i, j int) bool { return slos[i].Name < slos[j].Name })
+	writeJSON(w, http.StatusOK, slos)
+}
+
+func (h *Handler) getSLO(w http.ResponseWriter, r *http.Request) {
+	name := route.Param(r.Context(), "name")
+	rulesManager, err := NewCachedRulesManager()
+	if err != nil {
+		h.writeError(w, "SLOs cannot be read", err)
+		return
+	}
+	slo, ok := rulesManager.slos()[name]
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(w, "SLO %q does not exist.\n", name)
+		return
+	}
+	writeJSON(w, http.StatusOK, slo)
+}
+
+func (h *Handler) putSLO(w http.ResponseWriter, r *http.Request) {
+	name := route.Param(r.Context(), "name")
+	var slo SLO
+	if !h.decodeRules(w, r, &slo) {
+		return
+	}
+	if slo.Name == "" {
+		slo.Name = name
+	}
+	if slo.Name != name {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "SLO name %q does not match the path.\n", slo.Name)
+		return
+	}
+
+	op := putSLOOp(slo)
+	if r.URL.Query().Get("dryRun") == "true" {
+		h.dryRun(w, op)
+		return
+	}
+	if err := h.write(w, r, op); err != nil {
+		h.writeError(w, "SLO cannot be written", err)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, "SLO is written successfully.\n")
+}
+
+func (h *Handler) deleteSLO(w http.ResponseWriter, r *http.Request) {
+	op := deleteSLOOp(route.Param(r.Context(), "name"))
+	if r.URL.Query().Get("dryRun") == "true" {
+		h.dryRun(w, op)
+		return
+	}
+	if err := h.write(w, r, op); err != nil {
+		h.writeError(w, "SLO cannot be deleted", err)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, "SLO is deleted successfully.\n")
+}
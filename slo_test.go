@@ -0,0 +1,118 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/model"
+)
+
+func TestSLOGenerate(t *testing.T) {
+	sli := SLI{ErrorRatio: `sum(rate(http_requests_total{code=~"5.."}[{{.window}}])) / sum(rate(http_requests_total[{{.window}}]))`}
+
+	for _, tc := range []struct {
+		name string
+		slo  SLO
+		// thresholds are the burn rate thresholds of the page and ticket
+		// alerts.
+		thresholds map[string][]string
+		err        error
+	}{
+		{
+			name: "default window",
+			slo:  SLO{Name: "api", Service: "api", SLI: sli, Objective: 0.999},
+			thresholds: map[string][]string{
+				"page":   {"(14.4 * (1 - 0.999))", "(6 * (1 - 0.999))"},
+				"ticket": {"(3 * (1 - 0.999))", "(1 * (1 - 0.999))"},
+			},
+		},
+		{
+			name: "28d window",
+			slo:  SLO{Name: "api", Service: "api", SLI: sli, Objective: 0.99, Window: model.Duration(28 * 24 * time.Hour)},
+			thresholds: map[string][]string{
+				"page":   {"(13.44 * (1 - 0.99))", "(5.6 * (1 - 0.99))"},
+				"ticket": {"(2.8 * (1 - 0.99))", "(0.933333 * (1 - 0.99))"},
+			},
+		},
+		{
+			name: "good and total queries",
+			slo: SLO{Name: "api", Service: "api", Objective: 0.999, SLI: SLI{
+				Good:  `sum(rate(http_requests_total{code!~"5.."}[{{.window}}]))`,
+				Total: `sum(rate(http_requests_total[{{.window}}]))`,
+			}},
+			thresholds: map[string][]string{
+				"page":   {"(14.4 * (1 - 0.999))", "(6 * (1 - 0.999))"},
+				"ticket": {"(3 * (1 - 0.999))", "(1 * (1 - 0.999))"},
+			},
+		},
+		{
+			name: "query without window",
+			slo: SLO{Name: "api", Service: "api", Objective: 0.999, SLI: SLI{
+				Good:  `sum(rate(http_requests_total{code!~"5.."}[{{.window}}]))`,
+				Total: `sum(rate(http_requests_total[5m]))`,
+			}},
+			err: errSLOInvalid,
+		},
+		{
+			name: "objective out of range",
+			slo:  SLO{Name: "api", Service: "api", SLI: sli, Objective: 99.9},
+			err:  errSLOInvalid,
+		},
+		{
+			name: "window shorter than the longest alert window",
+			slo:  SLO{Name: "api", Service: "api", SLI: sli, Objective: 0.999, Window: model.Duration(24 * time.Hour)},
+			err:  errSLOInvalid,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			group, err := tc.slo.generate()
+			if !errors.Is(err, tc.err) {
+				t.Fatalf("err = %v, want %v", err, tc.err)
+			}
+			if tc.err != nil {
+				return
+			}
+			if group.Name != "slo-api" {
+				t.Errorf("group name = %q, want slo-api", group.Name)
+			}
+			records := 0
+			for _, r := range group.Rules {
+				if r.Record == "" {
+					continue
+				}
+				records++
+				if r.Labels["slo"] != "api" {
+					t.Errorf("recording rule %s is not labeled with the SLO", r.Record)
+				}
+			}
+			if records != len(sloWindows)+1 {
+				t.Errorf("%d recording rules, want %d", records, len(sloWindows)+1)
+			}
+			alerts := map[string]bool{}
+			for _, r := range group.Rules {
+				if r.Alert == "" {
+					continue
+				}
+				severity := r.Labels["severity"]
+				thresholds, ok := tc.thresholds[severity]
+				if !ok {
+					t.Errorf("unexpected alert of severity %q", severity)
+					continue
+				}
+				for _, threshold := range thresholds {
+					if !strings.Contains(r.Expr, threshold) {
+						t.Errorf("%s alert does not use threshold %s:\n%s", severity, threshold, r.Expr)
+					}
+				}
+				alerts[severity] = true
+			}
+			for severity := range tc.thresholds {
+				if !alerts[severity] {
+					t.Errorf("no %s alert", severity)
+				}
+			}
+		})
+	}
+}
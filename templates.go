@@ -0,0 +1,507 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/common/route"
+	"golang.org/x/exp/slices"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	// templatesAnnotation stores the rule templates, as a JSON object mapping
+	// template names to templates.
+	templatesAnnotation = annotationPrefix + "templates"
+	// templateInstancesAnnotation stores the groups rendered from templates,
+	// as a JSON object mapping group names to instances.
+	templateInstancesAnnotation = annotationPrefix + "template-instances"
+)
+
+// templateLabel tags the rules rendered from a template with its name. The
+// version rendered is an annotation of the alerting rules instead, so that
+// updating the template does not change the labels of the alerts. Recording
+// rules have no annotations, their version is kept in the instance.
+const (
+	templateLabel             = "template"
+	templateVersionAnnotation = "template_version"
+)
+
+// Template parameter types.
+const (
+	paramString   = "string"
+	paramInt      = "int"
+	paramFloat    = "float"
+	paramBool     = "bool"
+	paramDuration = "duration"
+)
+
+var (
+	errTemplateNotFound = errors.New("template not found")
+	// errTemplateInvalid is returned for templates, parameters and rendered
+	// groups which are not valid.
+	errTemplateInvalid = errors.New("invalid template")
+	// errTemplateInUse is returned when deleting a template with instances.
+	errTemplateInUse = errors.New("template has instances")
+	// errNotTemplateInstance is returned when instantiating a template would
+	// replace a group which is not an instance of it.
+	errNotTemplateInstance = errors.New("group is not an instance of the template")
+)
+
+// templateFuncs are the functions available to templates besides the
+// builtins.
+var templateFuncs = template.FuncMap{
+	// quote renders a value as a double-quoted YAML scalar, so that it
+	// cannot change the structure of the rendered group.
+	"quote": func(v interface{}) string {
+		return strconv.Quote(fmt.Sprint(v))
+	},
+}
+
+// Template renders a rule group from typed parameters.
+type Template struct {
+	Name string `json:"name"`
+	// Version is incremented by every update of the template.
+	Version     int             `json:"version,omitempty"`
+	Description string          `json:"description,omitempty"`
+	Params      []TemplateParam `json:"params"`
+	// Group is a text/template rendering the rule group as YAML, the
+	// parameters are its data. Values are inserted as they are unless
+	// passed to quote.
+	Group string `json:"group"`
+}
+
+// TemplateParam is a parameter of a template. Parameters without a default
+// are required.
+type TemplateParam struct {
+	Name        string      `json:"name"`
+	Type        string      `json:"type"`
+	Description string      `json:"description,omitempty"`
+	Default     interface{} `json:"default,omitempty"`
+}
+
+// TemplateInstance is a group rendered from a template.
+type TemplateInstance struct {
+	Template string                 `json:"template"`
+	Version  int                    `json:"version"`
+	Group    string                 `json:"group"`
+	Params   map[string]interface{} `json:"params"`
+}
+
+// InstantiateRequest holds the parameters to render a template with.
+type InstantiateRequest struct {
+	Params map[string]interface{} `json:"params"`
+}
+
+// value converts v, as decoded from JSON, to the type of the parameter.
+func (p TemplateParam) value(v interface{}) (interface{}, error) {
+	switch p.Type {
+	case paramString:
+		if s, ok := v.(string); ok {
+			// Line breaks would let the value add keys to the rendered
+			// group.
+			if strings.ContainsAny(s, "\n\r") {
+				return nil, fmt.Errorf("%w: parameter %q must not contain line breaks", errTemplateInvalid, p.Name)
+			}
+			return s, nil
+		}
+	case paramInt:
+		if f, ok := v.(float64); ok && f == math.Trunc(f) {
+			return int64(f), nil
+		}
+	case paramFloat:
+		if f, ok := v.(float64); ok {
+			return f, nil
+		}
+	case paramBool:
+		if b, ok := v.(bool); ok {
+			return b, nil
+		}
+	case paramDuration:
+		if s, ok := v.(string); ok {
+			d, err := model.ParseDuration(s)
+			if err != nil {
+				return nil, fmt.Errorf("%w: parameter %q: %s", errTemplateInvalid, p.Name, err)
+			}
+			return d, nil
+		}
+	default:
+		return nil, fmt.Errorf("%w: parameter %q has unknown type %q", errTemplateInvalid, p.Name, p.Type)
+	}
+	return nil, fmt.Errorf("%w: parameter %q must be a %s, got %v", errTemplateInvalid, p.Name, p.Type, v)
+}
+
+// validate checks the parameters and parses the template.
+func (t Template) validate() (*template.Template, error) {
+	if t.Name == "" {
+		return nil, fmt.Errorf("%w: name is empty", errTemplateInvalid)
+	}
+	seen := map[string]struct{}{}
+	for _, p := range t.Params {
+		if !model.LabelName(p.Name).IsValid() {
+			return nil, fmt.Errorf("%w: invalid parameter name %q", errTemplateInvalid, p.Name)
+		}
+		if _, ok := seen[p.Name]; ok {
+			return nil, fmt.Errorf("%w: duplicate parameter %q", errTemplateInvalid, p.Name)
+		}
+		seen[p.Name] = struct{}{}
+		switch p.Type {
+		case paramString, paramInt, paramFloat, paramBool, paramDuration:
+		default:
+			return nil, fmt.Errorf("%w: parameter %q has unknown type %q", errTemplateInvalid, p.Name, p.Type)
+		}
+		if p.Default != nil {
+			if _, err := p.value(p.Default); err != nil {
+				return nil, fmt.Errorf("default: %w", err)
+			}
+		}
+	}
+	tmpl, err := template.New(t.Name).Option("missingkey=error").Funcs(templateFuncs).Parse(t.Group)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", errTemplateInvalid, err)
+	}
+	return tmpl, nil
+}
+
+// render renders the group of the template with params. The rendered group
+// is validated and its rules are tagged with the template name.
+func (t Template) render(params map[string]interface{}) (SimpleRuleGroup, error) {
+	var group SimpleRuleGroup
+	tmpl, err := t.validate()
+	if err != nil {
+		return group, err
+	}
+	data := make(map[string]interface{}, len(t.Params))
+	for _, p := range t.Params {
+		v, ok := params[p.Name]
+		if !ok {
+			if v = p.Default; v == nil {
+				return group, fmt.Errorf("%w: parameter %q is required", errTemplateInvalid, p.Name)
+			}
+		}
+		if data[p.Name], err = p.value(v); err != nil {
+			return group, err
+		}
+	}
+	for name := range params {
+		if _, ok := data[name]; !ok {
+			return group, fmt.Errorf("%w: unknown parameter %q", errTemplateInvalid, name)
+		}
+	}
+
+	var b bytes.Buffer
+	if err := tmpl.Execute(&b, data); err != nil {
+		return group, fmt.Errorf("%w: %s", errTemplateInvalid, err)
+	}
+	decoder := yaml.NewDecoder(&b)
+	decoder.KnownFields(true)
+	if err := decoder.Decode(&group); err != nil {
+		return group, fmt.Errorf("%w: rendered group cannot be decoded: %s", errTemplateInvalid, err)
+	}
+	for i, r := range group.Rules {
+		labels := make(map[string]string, len(r.Labels)+1)
+		for k, v := range r.Labels {
+			labels[k] = v
+		}
+		labels[templateLabel] = t.Name
+		group.Rules[i].Labels = labels
+		if r.Alert != "" {
+			annotations := make(map[string]string, len(r.Annotations)+1)
+			for k, v := range r.Annotations {
+				annotations[k] = v
+			}
+			annotations[templateVersionAnnotation] = strconv.Itoa(t.Version)
+			group.Rules[i].Annotations = annotations
+		}
+	}
+	problems, err := validateGroup(group)
+	if err != nil {
+		return group, err
+	}
+	if len(problems) > 0 {
+		return group, fmt.Errorf("%w: rendered group has errors: %s", errTemplateInvalid, strings.Join(problems, "; "))
+	}
+	return group, nil
+}
+
+// templates returns the stored templates by name.
+func (manager *RulesManager) templates() map[string]Template {
+	templates := map[string]Template{}
+	if v, ok := manager.annotations[templatesAnnotation]; ok {
+		// A corrupted annotation loses the templates, not the rules.
+		json.Unmarshal([]byte(v), &templates)
+	}
+	return templates
+}
+
+// setTemplates stores the templates.
+func (manager *RulesManager) setTemplates(templates map[string]Template) {
+	if len(templates) == 0 {
+		delete(manager.annotations, templatesAnnotation)
+		return
+	}
+	b, _ := json.Marshal(templates)
+	manager.annotations[templatesAnnotation] = string(b)
+}
+
+// templateInstances returns the groups rendered from templates. Groups which
+// no longer exist are left out.
+func (manager *RulesManager) templateInstances() map[string]TemplateInstance {
+	instances := map[string]TemplateInstance{}
+	if v, ok := manager.annotations[templateInstancesAnnotation]; ok {
+		json.Unmarshal([]byte(v), &instances)
+	}
+	existing := map[string]struct{}{}
+	for _, g := range manager.ruleGroups.Groups {
+		existing[g.Name] = struct{}{}
+	}
+	for group := range instances {
+		if _, ok := existing[group]; !ok {
+			delete(instances, group)
+		}
+	}
+	return instances
+}
+
+// setTemplateInstances stores the groups rendered from templates.
+func (manager *RulesManager) setTemplateInstances(instances map[string]TemplateInstance) {
+	if len(instances) == 0 {
+		delete(manager.annotations, templateInstancesAnnotation)
+		return
+	}
+	b, _ := json.Marshal(instances)
+	manager.annotations[templateInstancesAnnotation] = string(b)
+}
+
+// putTemplateOp creates or updates a template. The instances of an updated
+// template are rendered again, the update fails if any of them cannot be.
+func putTemplateOp(t Template) writeOp {
+	return writeOp{
+		description: fmt.Sprintf("Put template %q", t.Name),
+		mutate: func(manager *RulesManager) error {
+			if _, err := t.validate(); err != nil {
+				return err
+			}
+			templates := manager.templates()
+			t := t
+			t.Version = 1
+			if old, ok := templates[t.Name]; ok {
+				t.Version = old.Version
+				if reflect.DeepEqual(old, t) {
+					return nil
+				}
+				t.Version++
+			}
+			templates[t.Name] = t
+			manager.setTemplates(templates)
+
+			instances := manager.templateInstances()
+			names := make([]string, 0, len(instances))
+			for name, instance := range instances {
+				if instance.Template == t.Name {
+					names = append(names, name)
+				}
+			}
+			sort.Strings(names)
+			for _, name := range names {
+				params := instances[name].Params
+				group, err := t.render(params)
+				if err == nil {
+					err = manager.instantiate(t, group, params, name, instances)
+				}
+				if err != nil {
+					return fmt.Errorf("instance %q: %w", name, err)
+				}
+			}
+			manager.setTemplateInstances(instances)
+			return nil
+		},
+	}
+}
+
+// deleteTemplateOp deletes a template without instances.
+func deleteTemplateOp(name string) writeOp {
+	return writeOp{
+		description: fmt.Sprintf("Delete template %q", name),
+		mutate: func(manager *RulesManager) error {
+			templates := manager.templates()
+			if _, ok := templates[name]; !ok {
+				return fmt.Errorf("%w: %q", errTemplateNotFound, name)
+			}
+			for group, instance := range manager.templateInstances() {
+				if instance.Template == name {
+					return fmt.Errorf("%w: %q is rendered into group %q", errTemplateInUse, name, group)
+				}
+			}
+			delete(templates, name)
+			manager.setTemplates(templates)
+			return nil
+		},
+	}
+}
+
+// instantiateOp renders the named template with params and writes the group.
+// The group it renders must not exist or be an instance of the template.
+// rendered is set to the name of the group.
+func instantiateOp(name string, params map[string]interface{}, rendered *string) writeOp {
+	return writeOp{
+		description: fmt.Sprintf("Instantiate template %q", name),
+		mutate: func(manager *RulesManager) error {
+			t, ok := manager.templates()[name]
+			if !ok {
+				return fmt.Errorf("%w: %q", errTemplateNotFound, name)
+			}
+			group, err := t.render(params)
+			if err != nil {
+				return err
+			}
+			instances := manager.templateInstances()
+			if err := manager.instantiate(t, group, params, "", instances); err != nil {
+				return err
+			}
+			manager.setTemplateInstances(instances)
+			*rendered = group.Name
+			return nil
+		},
+	}
+}
+
+// instantiate writes group, rendered from t with params, and records the
+// instance in instances. The group replaces the instance previous, if set, and
+// must not replace a group which is not an instance of t.
+func (manager *RulesManager) instantiate(t Template, group SimpleRuleGroup, params map[string]interface{}, previous string, instances map[string]TemplateInstance) error {
+	if group.Name != previous {
+		instance, ok := instances[group.Name]
+		if ok && instance.Template != t.Name {
+			return fmt.Errorf("%w %q: %q", errNotTemplateInstance, t.Name, group.Name)
+		}
+		if !ok && slices.IndexFunc(manager.ruleGroups.Groups, func(g RuleGroup) bool { return g.Name == group.Name }) >= 0 {
+			return fmt.Errorf("%w %q: %q", errNotTemplateInstance, t.Name, group.Name)
+		}
+		if i := slices.IndexFunc(manager.ruleGroups.Groups, func(g RuleGroup) bool { return g.Name == previous }); previous != "" && i >= 0 {
+			manager.ruleGroups.Groups = slices.Delete(manager.ruleGroups.Groups, i, i+1)
+			delete(instances, previous)
+		}
+	}
+	manager.importGroups([]RuleGroup{newRuleGroupNode(manager.canonicalizeGroup(group))}, importReplaceGroups)
+	instances[group.Name] = TemplateInstance{Template: t.Name, Version: t.Version, Group: group.Name, Params: params}
+	return nil
+}
+
+func (h *Handler) listTemplates(w http.ResponseWriter, r *http.Request) {
+	rulesManager, err := NewCachedRulesManager()
+	if err != nil {
+		h.writeError(w, "Templates cannot be read", err)
+		return
+	}
+	templates := []Template{}
+	for _, t := range rulesManager.templates() {
+		templates = append(templates, t)
+	}
+	sort.Slice(templates, func(i, j int) bool { return templates[i].Name < templates[j].Name })
+	writeJSON(w, http.StatusOK, templates)
+}
+
+func (h *Handler) getTemplate(w http.ResponseWriter, r *http.Request) {
+	name := route.Param(r.Context(), "name")
+	rulesManager, err := NewCachedRulesManager()
+	if err != nil {
+		h.writeError(w, "Templates cannot be read", err)
+		return
+	}
+	t, ok := rulesManager.templates()[name]
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(w, "Template %q does not exist.\n", name)
+		return
+	}
+	writeJSON(w, http.StatusOK, t)
+}
+
+func (h *Handler) listTemplateInstances(w http.ResponseWriter, r *http.Request) {
+	name := route.Param(r.Context(), "name")
+	rulesManager, err := NewCachedRulesManager()
+	if err != nil {
+		h.writeError(w, "Templates cannot be read", err)
+		return
+	}
+	instances := []TemplateInstance{}
+	for _, instance := range rulesManager.templateInstances() {
+		if instance.Template == name {
+			instances = append(instances, instance)
+		}
+	}
+	sort.Slice(instances, func(i, j int) bool { return instances[i].Group < instances[j].Group })
+	writeJSON(w, http.StatusOK, instances)
+}
+
+func (h *Handler) putTemplate(w http.ResponseWriter, r *http.Request) {
+	name := route.Param(r.Context(), "name")
+	var t Template
+	if !h.decodeRules(w, r, &t) {
+		return
+	}
+	if t.Name == "" {
+		t.Name = name
+	}
+	if t.Name != name {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "Template name %q does not match the path.\n", t.Name)
+		return
+	}
+
+	op := putTemplateOp(t)
+	if r.URL.Query().Get("dryRun") == "true" {
+		h.dryRun(w, op)
+		return
+	}
+	if err := h.write(w, r, op); err != nil {
+		h.writeError(w, "Template cannot be written", err)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, "Template is written successfully.\n")
+}
+
+func (h *Handler) deleteTemplate(w http.ResponseWriter, r *http.Request) {
+	op := deleteTemplateOp(route.Param(r.Context(), "name"))
+	if r.URL.Query().Get("dryRun") == "true" {
+		h.dryRun(w, op)
+		return
+	}
+	if err := h.write(w, r, op); err != nil {
+		h.writeError(w, "Template cannot be deleted", err)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, "Template is deleted successfully.\n")
+}
+
+func (h *Handler) instantiateTemplate(w http.ResponseWriter, r *http.Request) {
+	var req InstantiateRequest
+	if !h.decodeRules(w, r, &req) {
+		return
+	}
+	var group string
+	op := instantiateOp(route.Param(r.Context(), "name"), req.Params, &group)
+	if r.URL.Query().Get("dryRun") == "true" {
+		h.dryRun(w, op)
+		return
+	}
+	if err := h.write(w, r, op); err != nil {
+		h.writeError(w, "Template cannot be instantiated", err)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, "Group %q is instantiated successfully.\n", group)
+}
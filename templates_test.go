@@ -0,0 +1,105 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/model"
+)
+
+func TestTemplateRender(t *testing.T) {
+	tmpl := Template{
+		Name:    "availability",
+		Version: 3,
+		Params: []TemplateParam{
+			{Name: "job", Type: paramString},
+			{Name: "for", Type: paramDuration, Default: "5m"},
+			{Name: "summary", Type: paramString, Default: "Job is down"},
+		},
+		Group: `name: availability-{{.job}}
+rules:
+- alert: JobDown
+  expr: up{job="{{.job}}"} == 0
+  for: {{.for}}
+  labels:
+    severity: page
+  annotations:
+    summary: {{quote .summary}}
+`,
+	}
+
+	for _, tc := range []struct {
+		name   string
+		params map[string]interface{}
+		want   SimpleRuleGroup
+		err    error
+	}{
+		{
+			name:   "defaults",
+			params: map[string]interface{}{"job": "api"},
+			want: SimpleRuleGroup{Name: "availability-api", Rules: []Rule{{
+				Alert:       "JobDown",
+				Expr:        `up{job="api"} == 0`,
+				For:         model.Duration(5 * time.Minute),
+				Labels:      map[string]string{"severity": "page", templateLabel: "availability"},
+				Annotations: map[string]string{"summary": "Job is down", templateVersionAnnotation: "3"},
+			}}},
+		},
+		{
+			name:   "quoted value",
+			params: map[string]interface{}{"job": "api", "for": "10m", "summary": `API is "down": see #ops, 'now'`},
+			want: SimpleRuleGroup{Name: "availability-api", Rules: []Rule{{
+				Alert:       "JobDown",
+				Expr:        `up{job="api"} == 0`,
+				For:         model.Duration(10 * time.Minute),
+				Labels:      map[string]string{"severity": "page", templateLabel: "availability"},
+				Annotations: map[string]string{"summary": `API is "down": see #ops, 'now'`, templateVersionAnnotation: "3"},
+			}}},
+		},
+		{
+			name:   "line break in value",
+			params: map[string]interface{}{"job": "api\n- alert: Injected"},
+			err:    errTemplateInvalid,
+		},
+		{
+			name:   "missing parameter",
+			params: map[string]interface{}{},
+			err:    errTemplateInvalid,
+		},
+		{
+			name:   "unknown parameter",
+			params: map[string]interface{}{"job": "api", "team": "a"},
+			err:    errTemplateInvalid,
+		},
+		{
+			name:   "wrong type",
+			params: map[string]interface{}{"job": 1.0},
+			err:    errTemplateInvalid,
+		},
+		{
+			name:   "invalid duration",
+			params: map[string]interface{}{"job": "api", "for": "soon"},
+			err:    errTemplateInvalid,
+		},
+		{
+			name:   "invalid rendered rule",
+			params: map[string]interface{}{"job": `api"} ==`},
+			err:    errTemplateInvalid,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			group, err := tmpl.render(tc.params)
+			if !errors.Is(err, tc.err) {
+				t.Fatalf("err = %v, want %v", err, tc.err)
+			}
+			if tc.err != nil {
+				return
+			}
+			if !reflect.DeepEqual(group, tc.want) {
+				t.Errorf("group = %+v, want %+v", group, tc.want)
+			}
+		})
+	}
+}
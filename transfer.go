@@ -0,0 +1,269 @@
+package main
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/go-kit/log/level"
+	"gopkg.in/yaml.v3"
+)
+
+// maxImportSize limits the size of imported rule files.
+const maxImportSize = 8 << 20
+
+// Export formats.
+const (
+	exportYAML = "yaml"
+	exportJSON = "json"
+	exportTar  = "tar"
+)
+
+// Import strategies.
+const (
+	// importMerge adds the imported rules to the existing groups.
+	importMerge = "merge"
+	// importReplaceGroups replaces the existing groups with the imported
+	// groups of the same name.
+	importReplaceGroups = "replace-groups"
+	// importReplaceAll replaces all existing groups with the imported ones.
+	importReplaceAll = "replace-all"
+)
+
+var invalidFileNameChars = regexp.MustCompile(`[^a-zA-Z0-9._-]`)
+
+// Export writes the rule groups to w in the given format.
+func (manager *RulesManager) Export(w io.Writer, format string) error {
+	switch format {
+	case exportYAML:
+		return yaml.NewEncoder(w).Encode(manager.ruleGroups)
+	case exportJSON:
+		groups := make([]SimpleRuleGroup, 0, len(manager.ruleGroups.Groups))
+		for _, g := range manager.ruleGroups.Groups {
+			groups = append(groups, newSimpleRuleGroup(g))
+		}
+		return json.NewEncoder(w).Encode(struct {
+			Groups []SimpleRuleGroup `json:"groups"`
+		}{groups})
+	case exportTar:
+		tw := tar.NewWriter(w)
+		now := time.Now()
+		names := map[string]struct{}{}
+		for _, g := range manager.ruleGroups.Groups {
+			b, err := yaml.Marshal(&RuleGroups{Groups: []RuleGroup{g}})
+			if err != nil {
+				return err
+			}
+			// Group names which only differ in replaced characters are
+			// numbered so that no file overwrites another.
+			base := invalidFileNameChars.ReplaceAllString(g.Name, "_")
+			name := base + ".yml"
+			for i := 2; ; i++ {
+				if _, ok := names[name]; !ok {
+					break
+				}
+				name = fmt.Sprintf("%s-%d.yml", base, i)
+			}
+			names[name] = struct{}{}
+			err = tw.WriteHeader(&tar.Header{
+				Name:    name,
+				Mode:    0o644,
+				Size:    int64(len(b)),
+				ModTime: now,
+			})
+			if err != nil {
+				return err
+			}
+			if _, err := tw.Write(b); err != nil {
+				return err
+			}
+		}
+		return tw.Close()
+	default:
+		return fmt.Errorf("unknown export format %q", format)
+	}
+}
+
+// importOp applies the imported groups with the given strategy.
+func importOp(groups []RuleGroup, strategy string) writeOp {
+	return writeOp{
+		description: fmt.Sprintf("Import %d groups with strategy %s", len(groups), strategy),
+		mutate: func(manager *RulesManager) error {
+			manager.importGroups(manager.canonicalizeGroups(groups), strategy)
+			return nil
+		},
+	}
+}
+
+func (manager *RulesManager) importGroups(groups []RuleGroup, strategy string) {
+	switch strategy {
+	case importMerge:
+		for _, g := range groups {
+			manager.addRules(newSimpleRuleGroup(g))
+		}
+	case importReplaceGroups:
+		for _, g := range groups {
+			replaced := false
+			for i := range manager.ruleGroups.Groups {
+				if manager.ruleGroups.Groups[i].Name == g.Name {
+					manager.ruleGroups.Groups[i] = g
+					replaced = true
+					break
+				}
+			}
+			if !replaced {
+				manager.ruleGroups.Groups = append(manager.ruleGroups.Groups, g)
+			}
+		}
+	case importReplaceAll:
+		manager.ruleGroups.Groups = append([]RuleGroup{}, groups...)
+	}
+}
+
+// parseImport reads and parses the rule files of an import request, either
+// sent as the request body or as the files of a multipart form. The body must
+// be limited to maxImportSize.
+func parseImport(r *http.Request) ([]RuleGroup, []error) {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType != "multipart/form-data" {
+		b, err := io.ReadAll(r.Body)
+		if err != nil {
+			return nil, []error{err}
+		}
+		rgs, errs := Parse(b)
+		if len(errs) > 0 {
+			return nil, errs
+		}
+		return rgs.Groups, nil
+	}
+
+	if err := r.ParseMultipartForm(maxImportSize); err != nil {
+		return nil, []error{err}
+	}
+	var (
+		groups []RuleGroup
+		errs   []error
+		files  = map[string]string{}
+	)
+	for _, headers := range r.MultipartForm.File {
+		for _, fh := range headers {
+			f, err := fh.Open()
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", fh.Filename, err))
+				continue
+			}
+			b, err := io.ReadAll(f)
+			f.Close()
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", fh.Filename, err))
+				continue
+			}
+			rgs, fileErrs := Parse(b)
+			for _, err := range fileErrs {
+				errs = append(errs, fmt.Errorf("%s: %w", fh.Filename, err))
+			}
+			if len(fileErrs) > 0 {
+				continue
+			}
+			for _, g := range rgs.Groups {
+				if file, ok := files[g.Name]; ok {
+					errs = append(errs, fmt.Errorf("%s: groupname: %q is repeated in %s", fh.Filename, g.Name, file))
+					continue
+				}
+				files[g.Name] = fh.Filename
+				groups = append(groups, g)
+			}
+		}
+	}
+	if len(errs) > 0 {
+		return nil, errs
+	}
+	return groups, nil
+}
+
+func (h *Handler) exportRules(w http.ResponseWriter, r *http.Request) {
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = exportYAML
+	}
+	var contentType string
+	switch format {
+	case exportYAML:
+		contentType = "application/yaml"
+	case exportJSON:
+		contentType = "application/json"
+	case exportTar:
+		contentType = "application/x-tar"
+		w.Header().Set("Content-Disposition", `attachment; filename="rules.tar"`)
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "Unknown export format %q.\n", format)
+		return
+	}
+
+	rulesManager, err := NewCachedRulesManager()
+	if err != nil {
+		h.writeError(w, "Rules cannot be read", err)
+		return
+	}
+	w.Header().Set("Content-Type", contentType)
+	if err := rulesManager.Export(w, format); err != nil {
+		level.Error(h.logger).Log("msg", "Error exporting rules", "err", err)
+	}
+}
+
+func (h *Handler) importRules(w http.ResponseWriter, r *http.Request) {
+	level.Info(h.logger).Log("msg", "Import rules...")
+	strategy := r.URL.Query().Get("strategy")
+	if strategy == "" {
+		strategy = importMerge
+	}
+	switch strategy {
+	case importMerge, importReplaceGroups, importReplaceAll:
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "Unknown import strategy %q.\n", strategy)
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxImportSize)
+	groups, errs := parseImport(r)
+	for _, err := range errs {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			w.WriteHeader(http.StatusRequestEntityTooLarge)
+			fmt.Fprintf(w, "Rule files exceed the limit of %d bytes.\n", maxImportSize)
+			return
+		}
+	}
+	if len(errs) > 0 {
+		validationFailures.WithLabelValues(validationParse).Inc()
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "Rule file has errors:\n")
+		for _, err := range errs {
+			fmt.Fprintf(w, "%s\n", strings.TrimSpace(err.Error()))
+		}
+		return
+	}
+	// An empty upload, e.g. a wrong file, would delete every group.
+	if strategy == importReplaceAll && len(groups) == 0 && r.URL.Query().Get("confirm") != "true" {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "Importing no groups with strategy %s deletes all groups, set confirm=true to proceed.\n", importReplaceAll)
+		return
+	}
+
+	if err := h.write(w, r, importOp(groups, strategy)); err != nil {
+		h.writeError(w, "Rules cannot be imported", err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, "%d groups are imported successfully.\n", len(groups))
+}
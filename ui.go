@@ -0,0 +1,25 @@
+package main
+
+import (
+	"embed"
+	"io/fs"
+	"net/http"
+
+	"github.com/prometheus/common/route"
+)
+
+//go:embed ui
+var uiAssets embed.FS
+
+// serveUI serves the embedded web UI. It calls the API from the same origin,
+// so it is subject to the same authentication.
+func (h *Handler) serveUI(w http.ResponseWriter, r *http.Request) {
+	assets, err := fs.Sub(uiAssets, "ui")
+	if err != nil {
+		h.writeError(w, "UI cannot be served", err)
+		return
+	}
+	r.URL.Path = route.Param(r.Context(), "filepath")
+	w.Header().Set("Cache-Control", "no-cache")
+	http.FileServer(http.FS(assets)).ServeHTTP(w, r)
+}
@@ -0,0 +1,361 @@
+'use strict';
+
+// The API is served next to the UI, requests carry the same credentials.
+const api = (path) => new URL('../api/v1/' + path, location.href);
+const groupPath = (group) => 'groups/' + encodeURIComponent(group);
+
+const state = {
+  groups: [],
+  selected: null,
+  editing: null,
+};
+
+const $ = (id) => document.getElementById(id);
+
+function message(text, error) {
+  const el = $('message');
+  el.textContent = text;
+  el.style.background = error ? '#c22' : '#333';
+  el.classList.add('visible');
+  clearTimeout(message.timer);
+  message.timer = setTimeout(() => el.classList.remove('visible'), 5000);
+}
+
+async function request(method, path, body) {
+  const resp = await fetch(api(path), {
+    method,
+    credentials: 'same-origin',
+    headers: body ? { 'Content-Type': 'application/json' } : {},
+    body: body ? JSON.stringify(body) : undefined,
+  });
+  const text = await resp.text();
+  if (!resp.ok) {
+    throw new Error(text.trim() || resp.statusText);
+  }
+  const type = resp.headers.get('Content-Type') || '';
+  return type.includes('application/json') ? JSON.parse(text) : text;
+}
+
+function el(tag, attrs, ...children) {
+  const e = document.createElement(tag);
+  Object.entries(attrs || {}).forEach(([k, v]) => {
+    if (k.startsWith('on')) {
+      e.addEventListener(k.slice(2), v);
+    } else {
+      e.setAttribute(k, v);
+    }
+  });
+  children.flat().forEach((c) => e.append(c));
+  return e;
+}
+
+function labels(map) {
+  return Object.entries(map || {}).map(([k, v]) => el('span', { class: 'label' }, `${k}=${v}`));
+}
+
+// Rules list.
+
+async function loadRules() {
+  try {
+    state.groups = await request('GET', 'groups');
+    renderGroups();
+  } catch (err) {
+    message(`Rules cannot be loaded: ${err.message}`, true);
+  }
+}
+
+function matchesFilter(group, filter) {
+  if (!filter) {
+    return true;
+  }
+  return group.name.toLowerCase().includes(filter) ||
+    (group.rules || []).some((r) => (r.alert || r.record || '').toLowerCase().includes(filter));
+}
+
+function renderGroups() {
+  const filter = $('filter').value.trim().toLowerCase();
+  const list = $('groups');
+  list.replaceChildren();
+  state.groups.filter((g) => matchesFilter(g, filter)).forEach((g) => {
+    const item = el('li', { onclick: () => selectGroup(g.name) },
+      g.name, el('span', { class: 'count' }, String((g.rules || []).length)));
+    if (g.name === state.selected) {
+      item.classList.add('selected');
+    }
+    list.append(item);
+  });
+  renderGroup();
+}
+
+function selectGroup(name) {
+  state.selected = name;
+  renderGroups();
+}
+
+function renderGroup() {
+  const container = $('group');
+  const group = state.groups.find((g) => g.name === state.selected);
+  if (!group) {
+    container.replaceChildren(el('p', {}, 'Select a group to see its rules.'));
+    return;
+  }
+  const rows = (group.rules || []).map((rule) => el('tr', {},
+    el('td', {}, rule.alert ? 'alert' : 'record'),
+    el('td', {}, rule.alert || rule.record),
+    el('td', {}, el('code', {}, rule.expr)),
+    el('td', {}, rule.for || ''),
+    el('td', {}, labels(rule.labels)),
+    el('td', {},
+      el('button', { onclick: () => openEditor(group.name, rule) }, 'Edit'),
+      ' ',
+      el('button', { onclick: () => deleteRule(group.name, rule) }, 'Delete')),
+  ));
+  container.replaceChildren(
+    el('h2', {}, group.name, group.interval ? ` (every ${group.interval})` : ''),
+    el('table', {},
+      el('thead', {}, el('tr', {}, ['Type', 'Name', 'Expression', 'For', 'Labels', ''].map((h) => el('th', {}, h)))),
+      el('tbody', {}, rows)),
+  );
+}
+
+// rulePath is the path of the rules with the name and expression of rule.
+function rulePath(group, rule) {
+  const name = encodeURIComponent(rule.alert || rule.record);
+  return `${groupPath(group)}/rules/${name}?expr=${encodeURIComponent(rule.expr)}`;
+}
+
+async function deleteRule(group, rule) {
+  if (!confirm(`Delete ${rule.alert || rule.record} from ${group}?`)) {
+    return;
+  }
+  try {
+    await request('DELETE', rulePath(group, rule));
+    message('Rule deleted.');
+    loadRules();
+  } catch (err) {
+    message(`Rule cannot be deleted: ${err.message}`, true);
+  }
+}
+
+// Editor.
+
+function parsePairs(text) {
+  const map = {};
+  text.split('\n').map((l) => l.trim()).filter(Boolean).forEach((line) => {
+    const i = line.indexOf('=');
+    if (i > 0) {
+      map[line.slice(0, i).trim()] = line.slice(i + 1).trim();
+    }
+  });
+  return Object.keys(map).length ? map : undefined;
+}
+
+function formatPairs(map) {
+  return Object.entries(map || {}).map(([k, v]) => `${k}=${v}`).join('\n');
+}
+
+function formRule() {
+  const f = $('rule-form').elements;
+  const rule = { expr: f.expr.value.trim(), labels: parsePairs(f.labels.value) };
+  if (f.type.value === 'alert') {
+    rule.alert = f.name.value.trim();
+    rule.for = f.for.value.trim() || undefined;
+    rule.keep_firing_for = f.keep_firing_for.value.trim() || undefined;
+    rule.annotations = parsePairs(f.annotations.value);
+  } else {
+    rule.record = f.name.value.trim();
+  }
+  return { name: f.group.value.trim(), rules: [rule] };
+}
+
+function openEditor(group, rule) {
+  const f = $('rule-form').elements;
+  state.editing = rule ? { group, rule } : null;
+  $('editor-title').textContent = rule ? 'Edit rule' : 'New rule';
+  f.group.value = group || state.selected || '';
+  // An edited rule stays in its group, so that it is saved in one write.
+  f.group.readOnly = !!rule;
+  f.type.value = rule && rule.record ? 'record' : 'alert';
+  f.name.value = rule ? rule.alert || rule.record : '';
+  f.expr.value = rule ? rule.expr : '';
+  f.for.value = rule && rule.for ? rule.for : '';
+  f.keep_firing_for.value = rule && rule.keep_firing_for ? rule.keep_firing_for : '';
+  f.labels.value = formatPairs(rule && rule.labels);
+  f.annotations.value = formatPairs(rule && rule.annotations);
+  $('diff').hidden = true;
+  $('save').disabled = true;
+  toggleAlertFields();
+  validate();
+  $('editor').showModal();
+}
+
+function toggleAlertFields() {
+  const alerting = $('rule-form').elements.type.value === 'alert';
+  document.querySelectorAll('.alert-only').forEach((e) => { e.hidden = !alerting; });
+}
+
+// saveRequest returns the request saving the form: adding a new rule, or
+// replacing the edited rule in a single write of its group.
+async function saveRequest() {
+  const group = formRule();
+  if (!state.editing) {
+    return { method: 'POST', path: groupPath(group.name) + '/rules', body: group.rules };
+  }
+  const edited = JSON.stringify(state.editing.rule);
+  const current = await request('GET', groupPath(state.editing.group));
+  const rules = current.rules || [];
+  const i = rules.findIndex((r) => JSON.stringify(r) === edited);
+  if (i < 0) {
+    throw new Error('the edited rule was changed or deleted meanwhile, reload and edit it again');
+  }
+  rules[i] = group.rules[0];
+  return { method: 'PUT', path: groupPath(current.name), body: { ...current, rules } };
+}
+
+// validate checks the rule while it is typed, including its PromQL expression
+// and, if configured, against the live Prometheus.
+async function validate() {
+  const status = $('expr-status');
+  const group = formRule();
+  if (!group.name || !group.rules[0].expr || !(group.rules[0].alert || group.rules[0].record)) {
+    status.className = 'status';
+    status.textContent = '';
+    return;
+  }
+  const seq = (validate.seq = (validate.seq || 0) + 1);
+  try {
+    const result = await request('POST', 'rules/validate', group);
+    if (seq !== validate.seq) {
+      return;
+    }
+    if (result.errors.length) {
+      status.className = 'status error';
+      status.textContent = result.errors.join('\n');
+    } else if (result.warnings.length) {
+      status.className = 'status warning';
+      status.textContent = result.warnings.join('\n');
+    } else {
+      status.className = 'status ok';
+      status.textContent = 'Valid.';
+    }
+  } catch (err) {
+    status.className = 'status error';
+    status.textContent = err.message;
+  }
+}
+
+function renderDiff(diff) {
+  const pre = $('diff');
+  pre.replaceChildren();
+  pre.hidden = false;
+  if (!diff) {
+    pre.textContent = 'No changes.';
+    return;
+  }
+  diff.split('\n').forEach((line) => {
+    let cls = '';
+    if (line.startsWith('+') && !line.startsWith('+++')) {
+      cls = 'add';
+    } else if (line.startsWith('-') && !line.startsWith('---')) {
+      cls = 'del';
+    }
+    pre.append(el('span', { class: cls }, line + '\n'));
+  });
+}
+
+async function preview() {
+  try {
+    const req = await saveRequest();
+    const result = await request(req.method, req.path + '?dryRun=true', req.body);
+    renderDiff(result.diff);
+    $('save').disabled = false;
+  } catch (err) {
+    message(`Changes cannot be previewed: ${err.message}`, true);
+  }
+}
+
+async function save() {
+  const group = formRule();
+  try {
+    const req = await saveRequest();
+    const text = await request(req.method, req.path, req.body);
+    $('editor').close();
+    state.selected = group.name;
+    message(text.trim());
+    loadRules();
+  } catch (err) {
+    message(`Rule cannot be saved: ${err.message}`, true);
+  }
+}
+
+// History.
+
+function describeRules(verb, refs) {
+  if (!refs || !refs.length) {
+    return [];
+  }
+  return [el('div', {}, `${verb}: `, refs.map((r) => `${r.group}/${r.name}`).join(', '))];
+}
+
+async function loadHistory() {
+  try {
+    const events = await request('GET', 'history?limit=100');
+    $('history').replaceChildren(...events.map((ev) => el('li', {},
+      el('div', {}, el('strong', {}, ev.description)),
+      el('div', { class: 'meta' }, `${new Date(ev.time).toLocaleString()} by ${ev.actor}, revision ${ev.revision}`),
+      describeRules('Added', ev.added),
+      describeRules('Updated', ev.updated),
+      describeRules('Removed', ev.removed),
+    )));
+    if (!events.length) {
+      $('history').replaceChildren(el('p', {}, 'No changes since the manager started.'));
+    }
+  } catch (err) {
+    message(`History cannot be loaded: ${err.message}`, true);
+  }
+}
+
+// Live updates.
+
+function watch() {
+  const source = new EventSource(api('rules/watch'), { withCredentials: true });
+  source.onopen = () => $('live').classList.add('connected');
+  source.onerror = () => $('live').classList.remove('connected');
+  const refresh = () => {
+    loadRules();
+    if (!$('history-view').hidden) {
+      loadHistory();
+    }
+  };
+  source.addEventListener('change', refresh);
+  source.addEventListener('reset', refresh);
+}
+
+function showView(view) {
+  document.querySelectorAll('nav button[data-view]').forEach((b) => {
+    b.classList.toggle('active', b.dataset.view === view);
+  });
+  $('rules-view').hidden = view !== 'rules';
+  $('history-view').hidden = view !== 'history';
+  if (view === 'history') {
+    loadHistory();
+  }
+}
+
+document.querySelectorAll('nav button[data-view]').forEach((b) => {
+  b.addEventListener('click', () => showView(b.dataset.view));
+});
+$('new-rule').addEventListener('click', () => openEditor(null, null));
+$('filter').addEventListener('input', renderGroups);
+$('preview').addEventListener('click', preview);
+$('save').addEventListener('click', save);
+$('cancel').addEventListener('click', () => $('editor').close());
+$('rule-form').elements.type.addEventListener('change', toggleAlertFields);
+$('rule-form').addEventListener('input', () => {
+  $('save').disabled = true;
+  clearTimeout(validate.timer);
+  validate.timer = setTimeout(validate, 400);
+});
+
+loadRules();
+watch();
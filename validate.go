@@ -0,0 +1,114 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/pmezard/go-difflib/difflib"
+	"golang.org/x/exp/slices"
+	"gopkg.in/yaml.v3"
+)
+
+// ValidationResult lists the problems found in a rule group.
+type ValidationResult struct {
+	// Errors prevent the group from being written.
+	Errors []string `json:"errors"`
+	// Warnings come from the live checks against Prometheus and from
+	// conflicts the policy only warns about.
+	Warnings []string `json:"warnings"`
+}
+
+// DryRunResult describes the change a write would make without making it.
+type DryRunResult struct {
+	Description string `json:"description"`
+	// Diff is a unified diff of the rule file.
+	Diff string `json:"diff"`
+}
+
+// validateRules validates a rule group the way writing it would, without
+// writing it.
+func (h *Handler) validateRules(w http.ResponseWriter, r *http.Request) {
+	var ruleGroup SimpleRuleGroup
+	if !h.decodeRules(w, r, &ruleGroup) {
+		return
+	}
+
+	result := ValidationResult{Errors: []string{}, Warnings: []string{}}
+	problems, err := validateGroup(ruleGroup)
+	if err != nil {
+		h.writeError(w, "Rules cannot be validated", err)
+		return
+	}
+	if len(problems) > 0 {
+		result.Errors = append(result.Errors, problems...)
+		writeJSON(w, http.StatusOK, result)
+		return
+	}
+	rulesManager, err := NewCachedRulesManager()
+	if err != nil {
+		h.writeError(w, "Rules cannot be read", err)
+		return
+	}
+	for _, c := range addedConflicts(snapshot(rulesManager.ruleGroups), ruleGroup) {
+		switch c.Policy {
+		case conflictWarn:
+			result.Warnings = append(result.Warnings, c.Message)
+		case conflictReject:
+			result.Errors = append(result.Errors, c.Message)
+		}
+	}
+	if h.options.ExprChecker != nil {
+		result.Warnings = append(result.Warnings, h.options.ExprChecker.CheckGroup(r.Context(), rulesManager.ruleGroups, ruleGroup)...)
+	}
+	writeJSON(w, http.StatusOK, result)
+}
+
+// addedConflicts returns the conflicts adding the rules of group to groups
+// would introduce.
+func addedConflicts(groups []SimpleRuleGroup, group SimpleRuleGroup) []Conflict {
+	after := make([]SimpleRuleGroup, 0, len(groups)+1)
+	added := false
+	for _, g := range groups {
+		if g.Name == group.Name {
+			g.Rules = append(slices.Clone(g.Rules), group.Rules...)
+			added = true
+		}
+		after = append(after, g)
+	}
+	if !added {
+		after = append(after, group)
+	}
+	return newConflicts(findConflicts(groups), findConflicts(after))
+}
+
+// dryRun answers with the diff of the rule file op would make.
+func (h *Handler) dryRun(w http.ResponseWriter, op writeOp) {
+	rulesManager, err := NewRulesManager()
+	if err != nil {
+		h.writeError(w, "Rules cannot be read", err)
+		return
+	}
+	before, err := yaml.Marshal(rulesManager.ruleGroups)
+	if err != nil {
+		h.writeError(w, "Rules cannot be read", err)
+		return
+	}
+	_, warnings, err := rulesManager.apply(h.logger, op, findConflicts(snapshot(rulesManager.ruleGroups)))
+	if err != nil {
+		h.writeError(w, "Rules cannot be changed", err)
+		return
+	}
+	after, err := yaml.Marshal(rulesManager.ruleGroups)
+	if err != nil {
+		h.writeError(w, "Rules cannot be changed", err)
+		return
+	}
+	diff, _ := difflib.GetUnifiedDiffString(difflib.UnifiedDiff{
+		A:        difflib.SplitLines(string(before)),
+		B:        difflib.SplitLines(string(after)),
+		FromFile: "current/" + rulefileName,
+		ToFile:   "proposed/" + rulefileName,
+		Context:  3,
+	})
+	warnConflicts(w, warnings)
+	writeJSON(w, http.StatusOK, DryRunResult{Description: op.description, Diff: diff})
+}
@@ -0,0 +1,327 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+)
+
+const (
+	// watchBacklog is the number of events kept for resuming watches.
+	watchBacklog = 256
+	// watchBuffer is the number of events buffered per watch. Watches falling
+	// further behind are closed and resume on reconnect.
+	watchBuffer = 64
+	// watchKeepalive is the interval between comments keeping idle watches
+	// open through proxies.
+	watchKeepalive = 15 * time.Second
+	// rollbackSnapshots is the number of recent events the rule groups are
+	// kept for, to roll back to.
+	rollbackSnapshots = 20
+)
+
+// RuleRef identifies a rule in a group.
+type RuleRef struct {
+	Group string `json:"group"`
+	// Type is either alert or record.
+	Type   string            `json:"type"`
+	Name   string            `json:"name"`
+	Expr   string            `json:"expr"`
+	Labels map[string]string `json:"labels,omitempty"`
+	// OriginalExpr is the submitted expression, if it was formatted before
+	// it was written.
+	OriginalExpr string `json:"originalExpr,omitempty"`
+}
+
+// WatchEvent describes a committed change of the rule groups.
+type WatchEvent struct {
+	// Revision identifies the change. Revisions are assigned by the replica
+	// writing the changes, they restart when the leader changes.
+	Revision    string    `json:"revision"`
+	Time        time.Time `json:"time"`
+	Actor       string    `json:"actor"`
+	Description string    `json:"description"`
+	Added       []RuleRef `json:"added"`
+	Updated     []RuleRef `json:"updated"`
+	Removed     []RuleRef `json:"removed"`
+
+	// rules are the rule groups after the change. They are dropped once
+	// rollbackSnapshots newer events are published.
+	rules []SimpleRuleGroup
+}
+
+// Watcher keeps the recent changes and streams new ones to the watches.
+type Watcher struct {
+	logger log.Logger
+	// epoch distinguishes the revisions of this process from the ones of
+	// earlier processes.
+	epoch int64
+
+	mtx       sync.Mutex
+	revision  int64
+	backlog   []WatchEvent
+	watches   map[chan WatchEvent]struct{}
+	listeners []func(WatchEvent)
+	closed    bool
+}
+
+// NewWatcher returns a Watcher receiving all committed changes.
+func NewWatcher(logger log.Logger) *Watcher {
+	w := &Watcher{
+		logger:  logger,
+		epoch:   time.Now().UnixNano(),
+		watches: map[chan WatchEvent]struct{}{},
+	}
+	onChange(w.publish)
+	return w
+}
+
+func (w *Watcher) publish(c Change) {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+
+	w.revision++
+	added, updated, removed := diffRules(c.Before, c.After)
+	for _, refs := range [][]RuleRef{added, updated} {
+		for i, ref := range refs {
+			refs[i].OriginalExpr = c.Originals[originalKey(ref.Group, ref.Name, ref.Expr)]
+		}
+	}
+	ev := WatchEvent{
+		Revision:    fmt.Sprintf("%d-%d", w.epoch, w.revision),
+		Time:        c.Time,
+		Actor:       c.Actor,
+		Description: c.Description,
+		Added:       added,
+		Updated:     updated,
+		Removed:     removed,
+		rules:       c.After,
+	}
+	w.backlog = append(w.backlog, ev)
+	if len(w.backlog) > watchBacklog {
+		w.backlog = w.backlog[len(w.backlog)-watchBacklog:]
+	}
+	if i := len(w.backlog) - rollbackSnapshots - 1; i >= 0 {
+		w.backlog[i].rules = nil
+	}
+	for _, f := range w.listeners {
+		f(ev)
+	}
+	for ch := range w.watches {
+		select {
+		case ch <- ev:
+		default:
+			level.Warn(w.logger).Log("msg", "Closing watch falling behind")
+			delete(w.watches, ch)
+			close(ch)
+		}
+	}
+}
+
+// history returns up to limit of the recent events, newest first.
+func (w *Watcher) history(limit int) []WatchEvent {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+	events := make([]WatchEvent, 0, len(w.backlog))
+	for i := len(w.backlog) - 1; i >= 0 && (limit <= 0 || len(events) < limit); i-- {
+		events = append(events, w.backlog[i])
+	}
+	return events
+}
+
+// snapshot returns the rule groups after the change with the given revision.
+// It returns false if they are no longer kept.
+func (w *Watcher) snapshot(revision string) ([]SimpleRuleGroup, bool) {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+	for i := len(w.backlog) - 1; i >= 0; i-- {
+		if w.backlog[i].Revision == revision {
+			return w.backlog[i].rules, w.backlog[i].rules != nil
+		}
+	}
+	return nil, false
+}
+
+// onEvent registers f to be called for every event. f is called
+// synchronously from the write path and must not block.
+func (w *Watcher) onEvent(f func(WatchEvent)) {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+	w.listeners = append(w.listeners, f)
+}
+
+// subscribe returns the events after revision since and a channel receiving
+// the following ones. reset is set if the events after since are no longer
+// known, the watch then has to read the rules again.
+func (w *Watcher) subscribe(since string) (backlog []WatchEvent, ch chan WatchEvent, reset bool) {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+
+	ch = make(chan WatchEvent, watchBuffer)
+	if w.closed {
+		close(ch)
+		return nil, ch, false
+	}
+	w.watches[ch] = struct{}{}
+	if since == "" {
+		return nil, ch, false
+	}
+
+	epoch, revision, err := parseRevision(since)
+	if err != nil || epoch != w.epoch || revision > w.revision {
+		return nil, ch, true
+	}
+	if revision == w.revision {
+		return nil, ch, false
+	}
+	first := w.revision - int64(len(w.backlog)) + 1
+	if revision+1 < first {
+		return nil, ch, true
+	}
+	return append([]WatchEvent(nil), w.backlog[revision+1-first:]...), ch, false
+}
+
+func (w *Watcher) unsubscribe(ch chan WatchEvent) {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+	if _, ok := w.watches[ch]; ok {
+		delete(w.watches, ch)
+		close(ch)
+	}
+}
+
+// close ends all watches, so that they do not hold up shutdown.
+func (w *Watcher) close() {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+	w.closed = true
+	for ch := range w.watches {
+		delete(w.watches, ch)
+		close(ch)
+	}
+}
+
+// parseRevision parses a revision formatted as <epoch>-<revision>.
+func parseRevision(s string) (int64, int64, error) {
+	epoch, revision, ok := strings.Cut(s, "-")
+	if !ok {
+		return 0, 0, fmt.Errorf("invalid revision %q", s)
+	}
+	e, err := strconv.ParseInt(epoch, 10, 64)
+	if err != nil {
+		return 0, 0, err
+	}
+	r, err := strconv.ParseInt(revision, 10, 64)
+	if err != nil {
+		return 0, 0, err
+	}
+	return e, r, nil
+}
+
+// diffRules returns the rules added, updated and removed between before and
+// after. Rules are identified by their group, name and expression.
+func diffRules(before, after []SimpleRuleGroup) (added, updated, removed []RuleRef) {
+	type key struct{ group, typ, name, expr string }
+	added, updated, removed = []RuleRef{}, []RuleRef{}, []RuleRef{}
+	index := func(groups []SimpleRuleGroup) (map[key]Rule, []RuleRef) {
+		rules := map[key]Rule{}
+		var refs []RuleRef
+		for _, g := range groups {
+			for _, r := range g.Rules {
+				ref := RuleRef{Group: g.Name, Type: "alert", Name: r.Alert, Expr: r.Expr, Labels: r.Labels}
+				if r.Record != "" {
+					ref.Type, ref.Name = "record", r.Record
+				}
+				k := key{ref.Group, ref.Type, ref.Name, ref.Expr}
+				if _, ok := rules[k]; !ok {
+					refs = append(refs, ref)
+				}
+				rules[k] = r
+			}
+		}
+		return rules, refs
+	}
+	old, oldRefs := index(before)
+	cur, curRefs := index(after)
+	for _, ref := range curRefs {
+		k := key{ref.Group, ref.Type, ref.Name, ref.Expr}
+		o, ok := old[k]
+		switch {
+		case !ok:
+			added = append(added, ref)
+		case !reflect.DeepEqual(o, cur[k]):
+			updated = append(updated, ref)
+		}
+	}
+	for _, ref := range oldRefs {
+		if _, ok := cur[key{ref.Group, ref.Type, ref.Name, ref.Expr}]; !ok {
+			removed = append(removed, ref)
+		}
+	}
+	return added, updated, removed
+}
+
+// watchRules streams the committed changes as Server-Sent Events. A watch
+// resumes after the revision in the Last-Event-ID header or the since
+// parameter.
+func (h *Handler) watchRules(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, "Streaming is not supported.\n")
+		return
+	}
+	since := r.Header.Get("Last-Event-ID")
+	if since == "" {
+		since = r.URL.Query().Get("since")
+	}
+
+	backlog, ch, reset := h.options.Watcher.subscribe(since)
+	defer h.options.Watcher.unsubscribe(ch)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	if reset {
+		// The client missed changes and has to read the rules again.
+		fmt.Fprintf(w, "event: reset\ndata: {\"since\":%q}\n\n", since)
+	}
+	for _, ev := range backlog {
+		writeEvent(w, ev)
+	}
+	flusher.Flush()
+
+	keepalive := time.NewTicker(watchKeepalive)
+	defer keepalive.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case ev, ok := <-ch:
+			if !ok {
+				return
+			}
+			writeEvent(w, ev)
+		case <-keepalive.C:
+			fmt.Fprintf(w, ": keepalive\n\n")
+		}
+		flusher.Flush()
+	}
+}
+
+func writeEvent(w http.ResponseWriter, ev WatchEvent) {
+	b, err := json.Marshal(ev)
+	if err != nil {
+		return
+	}
+	fmt.Fprintf(w, "id: %s\nevent: change\ndata: %s\n\n", ev.Revision, b)
+}
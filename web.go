@@ -3,22 +3,27 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	stdlog "log"
 	"net"
 	"net/http"
 	"os"
 	"runtime"
+	"strconv"
 	"sync"
 	"time"
 
 	"github.com/go-kit/log"
 	"github.com/go-kit/log/level"
 	"github.com/mwitkow/go-conntrack"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/prometheus/common/route"
+	"github.com/prometheus/common/version"
 	toolkit_web "github.com/prometheus/exporter-toolkit/web"
 	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
 	"golang.org/x/net/netutil"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 )
 
 const (
@@ -26,10 +31,14 @@ const (
 	MaxConnections = 512
 )
 
-// withStackTrace logs the stack trace in case the request panics. The function
-// will re-raise the error which will then be handled by the net/http package.
-// It is needed because the go-kit log package doesn't manage properly the
-// panics from net/http (see https://github.com/go-kit/kit/issues/233).
+// readyCheckInterval is how long the result of the readiness check is reused,
+// so that frequent probes do not read the ConfigMaps every time.
+const readyCheckInterval = 5 * time.Second
+
+// withStackTrace logs the stack trace in case the request panics and answers
+// with an internal server error instead of letting net/http drop the
+// connection. It is needed because the go-kit log package doesn't manage
+// properly the panics from net/http (see https://github.com/go-kit/kit/issues/233).
 func withStackTracer(h http.Handler, l log.Logger) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		defer func() {
@@ -38,7 +47,7 @@ func withStackTracer(h http.Handler, l log.Logger) http.Handler {
 				buf := make([]byte, size)
 				buf = buf[:runtime.Stack(buf, false)]
 				level.Error(l).Log("msg", "panic while serving request", "client", r.RemoteAddr, "url", r.URL, "err", err, "stack", buf)
-				panic(err)
+				http.Error(w, "Internal server error.", http.StatusInternalServerError)
 			}
 		}()
 		h.ServeHTTP(w, r)
@@ -55,16 +64,69 @@ type Handler struct {
 	birth   time.Time
 	cwd     string
 
-	mtx sync.RWMutex
+	options *Options
+
+	readyMtx sync.Mutex
+	// readyAt is when the readiness check last ran, with result readyErr.
+	readyAt  time.Time
+	readyErr error
+}
+
+// BuildInfo contains build information about the binary.
+type BuildInfo struct {
+	Version   string `json:"version"`
+	Revision  string `json:"revision"`
+	Branch    string `json:"branch"`
+	BuildUser string `json:"buildUser"`
+	BuildDate string `json:"buildDate"`
+	GoVersion string `json:"goVersion"`
+}
+
+// RuntimeInfo contains runtime information about the process.
+type RuntimeInfo struct {
+	StartTime      time.Time `json:"startTime"`
+	CWD            string    `json:"CWD"`
+	GoroutineCount int       `json:"goroutineCount"`
+	GOMAXPROCS     int       `json:"GOMAXPROCS"`
+	GOGC           string    `json:"GOGC"`
+	GODEBUG        string    `json:"GODEBUG"`
+	Standalone     bool      `json:"standalone"`
+}
+
+// Options for the web Handler.
+type Options struct {
+	// ExprChecker checks new and changed expressions against a live
+	// Prometheus server before saving. Nil disables the check.
+	ExprChecker *ExprChecker
+	// AlertRenderer expands alerting rule templates for previews.
+	AlertRenderer *AlertRenderer
+	// GitSync syncs rules from a Git repository. Nil if disabled.
+	GitSync *GitSync
+	// DrainTimeout is the time in-flight requests are given to finish on
+	// shutdown.
+	DrainTimeout time.Duration
+	// WriteQueue serializes the writes of the rule groups.
+	WriteQueue *WriteQueue
+	// Watcher streams the committed changes.
+	Watcher *Watcher
+	// Idempotency replays the responses to requests with an
+	// Idempotency-Key. Nil if disabled.
+	Idempotency *IdempotencyStore
+	// LeaderElection elects the replica making writes. Nil if every replica
+	// writes.
+	LeaderElection *LeaderElection
+	// DriftReconciler detects changes of the ConfigMap made outside of the
+	// manager. Nil if disabled.
+	DriftReconciler *DriftReconciler
 }
 
 // New initializes a new web Handler.
-func NewHandler(logger log.Logger) *Handler {
+func NewHandler(logger log.Logger, o *Options) *Handler {
 	if logger == nil {
 		logger = log.NewNopLogger()
 	}
 
-	router := route.New()
+	router := route.New().WithInstrumentation(instrumentHandler)
 
 	cwd, err := os.Getwd()
 	if err != nil {
@@ -72,49 +134,237 @@ func NewHandler(logger log.Logger) *Handler {
 	}
 
 	h := &Handler{
-		logger: logger,
-		router: router,
-		cwd:    cwd,
+		logger:  logger,
+		router:  router,
+		birth:   time.Now(),
+		cwd:     cwd,
+		options: o,
 	}
 
-	router.Post("/api/rules/add", func(w http.ResponseWriter, r *http.Request) {
+	h.registerRoutes(router)
+
+	return h
+}
+
+// registerRoutes registers all routes of the handler.
+func (h *Handler) registerRoutes(router *route.Router) {
+	router.Get("/", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/ui/", http.StatusFound)
+	})
+	router.Get("/ui/*filepath", h.serveUI)
+
+	router.Get("/-/healthy", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprintf(w, "Rules Manager is Healthy.\n")
+	})
+	router.Get("/-/ready", func(w http.ResponseWriter, r *http.Request) {
+		if err := h.ready(); err != nil {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			fmt.Fprintf(w, "Rules Manager is not ready: %s\n", err)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprintf(w, "Rules Manager is Ready.\n")
+	})
+	versioned(router.Get, "/status/buildinfo", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, BuildInfo{
+			Version:   version.Version,
+			Revision:  version.Revision,
+			Branch:    version.Branch,
+			BuildUser: version.BuildUser,
+			BuildDate: version.BuildDate,
+			GoVersion: version.GoVersion,
+		})
+	})
+	versioned(router.Get, "/status/runtime", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, RuntimeInfo{
+			StartTime:      h.birth,
+			CWD:            h.cwd,
+			GoroutineCount: runtime.NumGoroutine(),
+			GOMAXPROCS:     runtime.GOMAXPROCS(0),
+			GOGC:           os.Getenv("GOGC"),
+			GODEBUG:        os.Getenv("GODEBUG"),
+			Standalone:     *standaloneMode,
+		})
+	})
+
+	versioned(router.Get, "/status/shards", func(w http.ResponseWriter, r *http.Request) {
+		rulesManager, err := NewCachedRulesManager()
+		if err != nil {
+			h.writeError(w, "Rules cannot be read", err)
+			return
+		}
+		writeJSON(w, http.StatusOK, rulesManager.shardStatus())
+	})
+
+	versioned(router.Get, "/status/leader", func(w http.ResponseWriter, r *http.Request) {
+		if h.options.LeaderElection == nil {
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprintf(w, "Leader election is not enabled.\n")
+			return
+		}
+		l := h.options.LeaderElection
+		writeJSON(w, http.StatusOK, LeaderStatus{
+			Identity: l.identity,
+			Leader:   l.Leader(),
+			IsLeader: l.IsLeader(),
+		})
+	})
+
+	versioned(router.Put, "/rules", h.leaderOnly(h.idempotent(h.applyRules)))
+	versioned(router.Get, "/export", h.exportRules)
+	// Changes are only committed on the leader, watches and the history
+	// follow it.
+	versioned(router.Get, "/rules/watch", h.leaderOnly(h.watchRules))
+	versioned(router.Get, "/history", h.leaderOnly(func(w http.ResponseWriter, r *http.Request) {
+		limit, _ := strconv.Atoi(r.URL.Query().Get("limit"))
+		writeJSON(w, http.StatusOK, h.options.Watcher.history(limit))
+	}))
+	versioned(router.Post, "/rules/validate", h.validateRules)
+	versioned(router.Post, "/import", h.leaderOnly(h.idempotent(h.importRules)))
+
+	versioned(router.Get, "/git/status", func(w http.ResponseWriter, r *http.Request) {
+		if h.options.GitSync == nil {
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprintf(w, "Git sync is not enabled.\n")
+			return
+		}
+		writeJSON(w, http.StatusOK, h.options.GitSync.Status())
+	})
+
+	versioned(router.Get, "/drift", func(w http.ResponseWriter, r *http.Request) {
+		if h.options.DriftReconciler == nil {
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprintf(w, "Drift detection is not enabled.\n")
+			return
+		}
+		writeJSON(w, http.StatusOK, h.options.DriftReconciler.Status())
+	})
+
+	router.Get("/metrics", promhttp.Handler().ServeHTTP)
+
+	// The RPC-style routes predate the versioned API, their successors are
+	// the rules of the group resource.
+	router.Post("/api/rules/add", deprecated(apiV1Prefix+"/groups/{group}/rules", h.leaderOnly(h.idempotent(func(w http.ResponseWriter, r *http.Request) {
 		level.Info(h.logger).Log("msg", "Add rules...")
-		decoder := json.NewDecoder(r.Body)
 		var ruleGroup SimpleRuleGroup
-		err := decoder.Decode(&ruleGroup)
-		if err != nil {
+		if !h.decodeRules(w, r, &ruleGroup) {
+			return
+		}
+		h.addRules(w, r, ruleGroup)
+	}))))
+	versioned(router.Post, "/rules/render", func(w http.ResponseWriter, r *http.Request) {
+		var req RenderRequest
+		if err := decodeJSON(r, &req); err != nil {
 			level.Error(h.logger).Log("msg", fmt.Sprintf("Error decoding request body: %s", err))
 			w.WriteHeader(http.StatusBadRequest)
-			fmt.Fprintf(w, "Group rules cannot be decoded.\n")
+			fmt.Fprintf(w, "Render request cannot be decoded.\n")
 			return
 		}
 
-		rulesManager := NewRulesManager()
-		rulesManager.AddRules(ruleGroup)
+		alerts, err := h.options.AlertRenderer.Render(r.Context(), req)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, "Rule cannot be rendered: %s\n", err)
+			return
+		}
 
-		w.WriteHeader(http.StatusOK)
-		fmt.Fprintf(w, "Rules are added successfully.\n")
+		writeJSON(w, http.StatusOK, alerts)
 	})
-	router.Post("/api/rules/delete", func(w http.ResponseWriter, r *http.Request) {
+	router.Post("/api/rules/delete", deprecated(apiV1Prefix+"/groups/{group}/rules/{rule}", h.leaderOnly(h.idempotent(func(w http.ResponseWriter, r *http.Request) {
 		level.Info(h.logger).Log("msg", "Delete rules...")
-		decoder := json.NewDecoder(r.Body)
 		var ruleGroup SimpleRuleGroup
-		err := decoder.Decode(&ruleGroup)
-		if err != nil {
-			level.Error(h.logger).Log("msg", fmt.Sprintf("Error decoding request body: %s", err))
-			w.WriteHeader(http.StatusBadRequest)
-			fmt.Fprintf(w, "Group rules cannot be decoded.\n")
+		if !h.decodeRules(w, r, &ruleGroup) {
 			return
 		}
 
-		rulesManager := NewRulesManager()
-		rulesManager.RemoveRules(ruleGroup)
+		if r.URL.Query().Get("dryRun") == "true" {
+			h.dryRun(w, removeRulesOp(ruleGroup))
+			return
+		}
+		if err := h.write(w, r, removeRulesOp(ruleGroup)); err != nil {
+			h.writeError(w, "Rules cannot be deleted", err)
+			return
+		}
 
 		w.WriteHeader(http.StatusOK)
 		fmt.Fprintf(w, "Rules are deleted successfully.\n")
-	})
+	}))))
+	h.registerAPI(router)
+}
 
-	return h
+// ready checks the rule file, reusing the last result for
+// readyCheckInterval.
+func (h *Handler) ready() error {
+	h.readyMtx.Lock()
+	defer h.readyMtx.Unlock()
+	if time.Since(h.readyAt) >= readyCheckInterval {
+		h.readyErr = checkRuleFile()
+		h.readyAt = time.Now()
+	}
+	return h.readyErr
+}
+
+// write queues op on behalf of the request's actor and waits for it to be
+// written. The conflicts the write introduced which the policy warns about are
+// returned as Warning headers.
+func (h *Handler) write(w http.ResponseWriter, r *http.Request, op writeOp) error {
+	var warnings []Conflict
+	op.warnings = &warnings
+	err := h.options.WriteQueue.Submit(r.Context(), requestActor(r), op)
+	if err == nil {
+		warnConflicts(w, warnings)
+	}
+	return err
+}
+
+// warnConflicts adds a Warning header for each of the conflicts.
+func warnConflicts(w http.ResponseWriter, conflicts []Conflict) {
+	for _, c := range conflicts {
+		w.Header().Add("Warning", fmt.Sprintf("299 - %q", c.Message))
+	}
+}
+
+// writeError logs err and answers with the status code matching it.
+func (h *Handler) writeError(w http.ResponseWriter, msg string, err error) {
+	level.Error(h.logger).Log("msg", msg, "err", err)
+	status := statusForError(err)
+	if status == http.StatusTooManyRequests {
+		w.Header().Set("Retry-After", "1")
+	}
+	w.WriteHeader(status)
+	fmt.Fprintf(w, "%s: %s\n", msg, err)
+}
+
+// statusForError maps errors from the Kubernetes API to HTTP status codes.
+func statusForError(err error) int {
+	switch {
+	case errors.Is(err, errNoClientset), errors.Is(err, errQueueClosed), apierrors.IsServiceUnavailable(err):
+		return http.StatusServiceUnavailable
+	case errors.Is(err, errTemplateInvalid), errors.Is(err, errSLOInvalid):
+		return http.StatusBadRequest
+	case apierrors.IsNotFound(err), errors.Is(err, errGroupNotFound), errors.Is(err, errRuleNotFound), errors.Is(err, errTemplateNotFound), errors.Is(err, errSLONotFound):
+		return http.StatusNotFound
+	case apierrors.IsForbidden(err), apierrors.IsUnauthorized(err):
+		return http.StatusForbidden
+	case apierrors.IsConflict(err), errors.Is(err, errRuleConflict), errors.Is(err, errTemplateInUse), errors.Is(err, errNotTemplateInstance), errors.Is(err, errGeneratedGroup):
+		return http.StatusConflict
+	case errors.Is(err, errRuleFileTooLarge):
+		return http.StatusRequestEntityTooLarge
+	case errors.Is(err, errQueueFull), apierrors.IsTooManyRequests(err):
+		return http.StatusTooManyRequests
+	case apierrors.IsTimeout(err), apierrors.IsServerTimeout(err), errors.Is(err, context.DeadlineExceeded):
+		return http.StatusGatewayTimeout
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// writeJSON writes v as the JSON body of the response.
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
 }
 
 // Listener creates the TCP listener for web requests.
@@ -160,6 +410,11 @@ func (h *Handler) Run(ctx context.Context, listener net.Listener, webConfig stri
 		ReadTimeout: time.Duration(0),
 	}
 
+	if h.options.Watcher != nil {
+		// Watches never end on their own.
+		httpSrv.RegisterOnShutdown(h.options.Watcher.close)
+	}
+
 	errCh := make(chan error, 1)
 	go func() {
 		errCh <- toolkit_web.Serve(listener, httpSrv, &toolkit_web.FlagConfig{WebConfigFile: &webConfig}, h.logger)
@@ -169,7 +424,13 @@ func (h *Handler) Run(ctx context.Context, listener net.Listener, webConfig stri
 	case e := <-errCh:
 		return e
 	case <-ctx.Done():
-		httpSrv.Shutdown(ctx)
+		// ctx is canceled already, in-flight requests get a fresh deadline.
+		level.Info(h.logger).Log("msg", "Draining in-flight requests", "timeout", h.options.DrainTimeout)
+		drainCtx, cancel := context.WithTimeout(context.Background(), h.options.DrainTimeout)
+		defer cancel()
+		if err := httpSrv.Shutdown(drainCtx); err != nil {
+			level.Warn(h.logger).Log("msg", "Requests still in flight after the drain timeout", "err", err)
+		}
 		return nil
 	}
 }
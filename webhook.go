@@ -0,0 +1,338 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/alecthomas/kingpin"
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	// webhookQueueSize is the number of events waiting for delivery per
+	// webhook. Events arriving when it is full go to the dead-letter log.
+	webhookQueueSize = 256
+	// webhookMaxBackoff caps the delay between delivery attempts.
+	webhookMaxBackoff = 5 * time.Minute
+)
+
+var (
+	webhookConfigFile = kingpin.Flag("webhook.config-file", "YAML file configuring the webhooks notified of rule changes. Webhooks are disabled if empty.").Default("").String()
+	webhookDeadLetter = kingpin.Flag("webhook.dead-letter-file", "File the events which cannot be delivered are appended to, as JSON lines.").Default("data/webhooks-dead-letter.jsonl").String()
+)
+
+// WebhookConfig configures a webhook.
+type WebhookConfig struct {
+	Name string `yaml:"name"`
+	URL  string `yaml:"url"`
+	// Secret signs the payloads, SecretFile is read if it is empty.
+	Secret     string `yaml:"secret"`
+	SecretFile string `yaml:"secret_file"`
+	// Groups are regular expressions matching the names of the groups the
+	// webhook is notified about. All groups match if empty.
+	Groups []string `yaml:"groups"`
+	// Labels must all be set on the rules the webhook is notified about.
+	Labels     map[string]string `yaml:"labels"`
+	Timeout    time.Duration     `yaml:"timeout"`
+	MaxRetries int               `yaml:"max_retries"`
+	// Backoff is the delay before the first retry, it doubles on every retry.
+	Backoff time.Duration `yaml:"backoff"`
+}
+
+// WebhooksConfig is the content of the webhook config file.
+type WebhooksConfig struct {
+	Webhooks []WebhookConfig `yaml:"webhooks"`
+}
+
+// WebhookPayload is the body of the requests sent to webhooks.
+type WebhookPayload struct {
+	Webhook string `json:"webhook"`
+	WatchEvent
+}
+
+// webhook delivers events to a single endpoint.
+type webhook struct {
+	WebhookConfig
+	secret []byte
+	groups []*regexp.Regexp
+	queue  chan WatchEvent
+}
+
+// Webhooks notifies the configured webhooks of every committed change.
+type Webhooks struct {
+	logger     log.Logger
+	client     *http.Client
+	webhooks   []*webhook
+	deadLetter string
+
+	// mtx serializes appends to the dead-letter log.
+	mtx sync.Mutex
+}
+
+// LoadWebhooks reads the webhook config file and registers the webhooks with
+// watcher.
+func LoadWebhooks(logger log.Logger, file string, watcher *Watcher) (*Webhooks, error) {
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var cfg WebhooksConfig
+	decoder := yaml.NewDecoder(bytes.NewReader(b))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(&cfg); err != nil {
+		return nil, fmt.Errorf("%s: %w", file, err)
+	}
+
+	w := &Webhooks{
+		logger:     logger,
+		client:     &http.Client{},
+		deadLetter: *webhookDeadLetter,
+	}
+	names := map[string]struct{}{}
+	for i, c := range cfg.Webhooks {
+		if c.Name == "" {
+			c.Name = strconv.Itoa(i)
+		}
+		if _, ok := names[c.Name]; ok {
+			return nil, fmt.Errorf("%s: webhook %q is repeated", file, c.Name)
+		}
+		names[c.Name] = struct{}{}
+		if c.URL == "" {
+			return nil, fmt.Errorf("%s: webhook %q has no url", file, c.Name)
+		}
+		if c.Timeout == 0 {
+			c.Timeout = 10 * time.Second
+		}
+		if c.MaxRetries == 0 {
+			c.MaxRetries = 5
+		}
+		if c.Backoff == 0 {
+			c.Backoff = time.Second
+		}
+		wh := &webhook{
+			WebhookConfig: c,
+			secret:        []byte(c.Secret),
+			queue:         make(chan WatchEvent, webhookQueueSize),
+		}
+		if c.Secret == "" && c.SecretFile != "" {
+			secret, err := os.ReadFile(c.SecretFile)
+			if err != nil {
+				return nil, fmt.Errorf("%s: webhook %q: %w", file, c.Name, err)
+			}
+			wh.secret = bytes.TrimSpace(secret)
+		}
+		for _, g := range c.Groups {
+			re, err := regexp.Compile("^(?:" + g + ")$")
+			if err != nil {
+				return nil, fmt.Errorf("%s: webhook %q: %w", file, c.Name, err)
+			}
+			wh.groups = append(wh.groups, re)
+		}
+		w.webhooks = append(w.webhooks, wh)
+	}
+	watcher.onEvent(w.enqueue)
+	return w, nil
+}
+
+// enqueue queues ev for the webhooks it passes the filters of.
+func (w *Webhooks) enqueue(ev WatchEvent) {
+	for _, wh := range w.webhooks {
+		filtered, ok := wh.filter(ev)
+		if !ok {
+			continue
+		}
+		select {
+		case wh.queue <- filtered:
+		default:
+			w.deadLetterEvent(wh, filtered, fmt.Errorf("too many pending events"))
+		}
+	}
+}
+
+// filter returns the part of ev the webhook is notified about. It returns
+// false if nothing is left.
+func (wh *webhook) filter(ev WatchEvent) (WatchEvent, bool) {
+	if len(wh.groups) == 0 && len(wh.Labels) == 0 {
+		return ev, true
+	}
+	match := func(refs []RuleRef) []RuleRef {
+		matched := []RuleRef{}
+		for _, ref := range refs {
+			if wh.matches(ref) {
+				matched = append(matched, ref)
+			}
+		}
+		return matched
+	}
+	ev.Added, ev.Updated, ev.Removed = match(ev.Added), match(ev.Updated), match(ev.Removed)
+	return ev, len(ev.Added)+len(ev.Updated)+len(ev.Removed) > 0
+}
+
+func (wh *webhook) matches(ref RuleRef) bool {
+	for name, value := range wh.Labels {
+		if ref.Labels[name] != value {
+			return false
+		}
+	}
+	if len(wh.groups) == 0 {
+		return true
+	}
+	for _, re := range wh.groups {
+		if re.MatchString(ref.Group) {
+			return true
+		}
+	}
+	return false
+}
+
+// Run delivers the queued events until ctx is canceled.
+func (w *Webhooks) Run(ctx context.Context) error {
+	var wg sync.WaitGroup
+	for _, wh := range w.webhooks {
+		wg.Add(1)
+		go func(wh *webhook) {
+			defer wg.Done()
+			for {
+				select {
+				case <-ctx.Done():
+					// Keep the events not delivered yet.
+					for {
+						select {
+						case ev := <-wh.queue:
+							w.deadLetterEvent(wh, ev, ctx.Err())
+						default:
+							return
+						}
+					}
+				case ev := <-wh.queue:
+					w.deliver(ctx, wh, ev)
+				}
+			}
+		}(wh)
+	}
+	wg.Wait()
+	return nil
+}
+
+// deliver sends ev to the webhook, retrying with exponential backoff. Events
+// which cannot be delivered go to the dead-letter log.
+func (w *Webhooks) deliver(ctx context.Context, wh *webhook, ev WatchEvent) {
+	body, err := json.Marshal(WebhookPayload{Webhook: wh.Name, WatchEvent: ev})
+	if err != nil {
+		w.deadLetterEvent(wh, ev, err)
+		return
+	}
+
+	backoff := wh.Backoff
+	for attempt := 0; ; attempt++ {
+		err = w.send(ctx, wh, ev, body)
+		if err == nil {
+			webhookDeliveries.WithLabelValues(wh.Name, "success").Inc()
+			return
+		}
+		level.Warn(w.logger).Log("msg", "Webhook delivery failed", "webhook", wh.Name, "revision", ev.Revision, "attempt", attempt+1, "err", err)
+		if attempt >= wh.MaxRetries {
+			break
+		}
+		webhookDeliveries.WithLabelValues(wh.Name, "retry").Inc()
+		select {
+		case <-ctx.Done():
+			w.deadLetterEvent(wh, ev, ctx.Err())
+			return
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; backoff > webhookMaxBackoff {
+			backoff = webhookMaxBackoff
+		}
+	}
+	w.deadLetterEvent(wh, ev, err)
+}
+
+// send makes a single delivery attempt. The payload is signed with
+// HMAC-SHA256 over the timestamp, a dot and the body.
+func (w *Webhooks) send(ctx context.Context, wh *webhook, ev WatchEvent, body []byte) error {
+	ctx, cancel := context.WithTimeout(ctx, wh.Timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, wh.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "prom-rules-manager")
+	req.Header.Set("X-Rules-Manager-Event", "change")
+	req.Header.Set("X-Rules-Manager-Delivery", ev.Revision)
+	req.Header.Set("X-Rules-Manager-Timestamp", timestamp)
+	if len(wh.secret) > 0 {
+		mac := hmac.New(sha256.New, wh.secret)
+		mac.Write([]byte(timestamp + "."))
+		mac.Write(body)
+		req.Header.Set("X-Rules-Manager-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
+
+// deadLetterEvent logs ev as undeliverable and appends it to the dead-letter
+// log.
+func (w *Webhooks) deadLetterEvent(wh *webhook, ev WatchEvent, cause error) {
+	webhookDeliveries.WithLabelValues(wh.Name, "dead_letter").Inc()
+	level.Error(w.logger).Log("msg", "Webhook event dead-lettered", "webhook", wh.Name, "revision", ev.Revision, "err", cause)
+
+	b, err := json.Marshal(struct {
+		Time    time.Time      `json:"time"`
+		Error   string         `json:"error"`
+		Payload WebhookPayload `json:"payload"`
+	}{time.Now(), cause.Error(), WebhookPayload{Webhook: wh.Name, WatchEvent: ev}})
+	if err != nil {
+		return
+	}
+
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+	if err := os.MkdirAll(filepath.Dir(w.deadLetter), 0o755); err != nil {
+		level.Error(w.logger).Log("msg", "Unable to write the dead-letter log", "err", err)
+		return
+	}
+	f, err := os.OpenFile(w.deadLetter, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		level.Error(w.logger).Log("msg", "Unable to write the dead-letter log", "err", err)
+		return
+	}
+	defer f.Close()
+	if _, err := f.Write(append(b, '\n')); err != nil {
+		level.Error(w.logger).Log("msg", "Unable to write the dead-letter log", "err", err)
+	}
+}
+
+// names returns the names of the configured webhooks.
+func (w *Webhooks) names() string {
+	names := make([]string, 0, len(w.webhooks))
+	for _, wh := range w.webhooks {
+		names = append(names, wh.Name)
+	}
+	return strings.Join(names, ", ")
+}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/alecthomas/kingpin"
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+)
+
+// maxBatchSize bounds the number of operations written in a single update.
+const maxBatchSize = 100
+
+var (
+	writeQueueCapacity    = kingpin.Flag("write-queue.capacity", "Maximum number of writes waiting in the queue, further writes are rejected with 429.").Default("100").Int()
+	writeQueueWindow      = kingpin.Flag("write-queue.batch-window", "Time writes are collected for before they are written to the ConfigMap in a single update.").Default("50ms").Duration()
+	writeQueueActorMaxLen = kingpin.Flag("write-queue.max-pending-per-actor", "Maximum number of writes of a single actor waiting in the queue, so that a busy client cannot take the whole queue.").Default("10").Int()
+)
+
+var (
+	// errQueueFull is returned when a write cannot be queued.
+	errQueueFull = errors.New("too many pending writes")
+	// errQueueClosed is returned for writes submitted during shutdown.
+	errQueueClosed = errors.New("write queue is shut down")
+)
+
+// writeOp is a mutation of the rule groups.
+type writeOp struct {
+	description string
+	mutate      func(*RulesManager) error
+	// exclusive ops are written in a batch of their own.
+	exclusive bool
+	// warnings, if set, receives the conflicts introduced by the op which
+	// the policy warns about.
+	warnings *[]Conflict
+}
+
+// queuedOp is a writeOp waiting in the queue.
+type queuedOp struct {
+	writeOp
+	actor string
+	done  chan error
+}
+
+// WriteQueue serializes all writes of the rule groups. Writes submitted within
+// the batch window are applied in a single read-modify-write update of the
+// ConfigMap, each getting its own result.
+type WriteQueue struct {
+	logger      log.Logger
+	window      time.Duration
+	maxPerActor int
+	ops         chan *queuedOp
+
+	// held is an exclusive op received while collecting a batch, it starts
+	// the next one. Only used by Run.
+	held *queuedOp
+
+	mtx     sync.Mutex
+	pending map[string]int
+	closed  bool
+}
+
+// NewWriteQueue returns a WriteQueue with the configured limits.
+func NewWriteQueue(logger log.Logger) *WriteQueue {
+	return &WriteQueue{
+		logger:      logger,
+		window:      *writeQueueWindow,
+		maxPerActor: *writeQueueActorMaxLen,
+		ops:         make(chan *queuedOp, *writeQueueCapacity),
+		pending:     map[string]int{},
+	}
+}
+
+// Submit queues op on behalf of actor and waits for it to be written. It
+// returns errQueueFull right away if the queue or the actor's share of it is
+// full.
+func (q *WriteQueue) Submit(ctx context.Context, actor string, op writeOp) error {
+	qop := &queuedOp{writeOp: op, actor: actor, done: make(chan error, 1)}
+
+	q.mtx.Lock()
+	switch {
+	case q.closed:
+		q.mtx.Unlock()
+		return errQueueClosed
+	case q.maxPerActor > 0 && q.pending[actor] >= q.maxPerActor:
+		q.mtx.Unlock()
+		writeQueueRejections.WithLabelValues("actor").Inc()
+		return fmt.Errorf("%w of %s", errQueueFull, actor)
+	}
+	select {
+	case q.ops <- qop:
+		q.pending[actor]++
+		writeQueueLength.Set(float64(len(q.ops)))
+	default:
+		q.mtx.Unlock()
+		writeQueueRejections.WithLabelValues("full").Inc()
+		return errQueueFull
+	}
+	q.mtx.Unlock()
+
+	select {
+	case err := <-qop.done:
+		return err
+	case <-ctx.Done():
+		// The write may still happen.
+		return ctx.Err()
+	}
+}
+
+// Run writes the queued operations until ctx is canceled. The operations
+// queued by then are written before it returns.
+func (q *WriteQueue) Run(ctx context.Context) error {
+	for {
+		select {
+		case <-ctx.Done():
+			q.mtx.Lock()
+			q.closed = true
+			q.mtx.Unlock()
+			for {
+				batch := q.collect(q.takeHeld(), 0)
+				if len(batch) == 0 {
+					return nil
+				}
+				q.write(batch)
+			}
+		case op := <-q.ops:
+			q.write(q.collect([]*queuedOp{op}, q.window))
+			for q.held != nil {
+				q.write(q.collect(q.takeHeld(), q.window))
+			}
+		}
+	}
+}
+
+// takeHeld returns the held op as the start of a batch, if any.
+func (q *WriteQueue) takeHeld() []*queuedOp {
+	if q.held == nil {
+		return nil
+	}
+	op := q.held
+	q.held = nil
+	return []*queuedOp{op}
+}
+
+// collect adds the operations arriving within window to batch. An exclusive
+// op ends the batch, it is held for the next one unless batch is empty.
+func (q *WriteQueue) collect(batch []*queuedOp, window time.Duration) []*queuedOp {
+	if len(batch) > 0 && batch[0].exclusive {
+		return batch
+	}
+	// add adds op to the batch and reports whether more ops may be added.
+	add := func(op *queuedOp) bool {
+		if !op.exclusive {
+			batch = append(batch, op)
+			return true
+		}
+		if len(batch) == 0 {
+			batch = append(batch, op)
+		} else {
+			q.held = op
+		}
+		return false
+	}
+	timer := time.NewTimer(window)
+	defer timer.Stop()
+	for len(batch) < maxBatchSize {
+		select {
+		case op := <-q.ops:
+			if !add(op) {
+				return batch
+			}
+			continue
+		default:
+		}
+		if window == 0 {
+			break
+		}
+		select {
+		case op := <-q.ops:
+			if !add(op) {
+				return batch
+			}
+		case <-timer.C:
+			return batch
+		}
+	}
+	return batch
+}
+
+// write applies the batch in a single update. Operations which fail are
+// rolled back without affecting the others.
+func (q *WriteQueue) write(batch []*queuedOp) {
+	writeBatchSize.Observe(float64(len(batch)))
+	writeQueueLength.Set(float64(len(q.ops)))
+
+	errs := make([]error, len(batch))
+	manager, err := NewRulesManager()
+	if err == nil {
+		var (
+			actors       []string
+			descriptions []string
+			seen         = map[string]struct{}{}
+		)
+		for _, op := range batch {
+			if _, ok := seen[op.actor]; !ok {
+				seen[op.actor] = struct{}{}
+				actors = append(actors, op.actor)
+			}
+			descriptions = append(descriptions, op.description)
+		}
+		manager.actor = strings.Join(actors, ", ")
+		description := descriptions[0]
+		if len(batch) > 1 {
+			description = fmt.Sprintf("Batch of %d writes: %s", len(batch), strings.Join(descriptions, "; "))
+		}
+
+		err = manager.update(description, func() error {
+			conflicts := findConflicts(snapshot(manager.ruleGroups))
+			for i, op := range batch {
+				var warnings []Conflict
+				conflicts, warnings, errs[i] = manager.apply(q.logger, op.writeOp, conflicts)
+				if op.warnings != nil {
+					*op.warnings = warnings
+				}
+			}
+			return nil
+		})
+	}
+	if err != nil {
+		level.Error(q.logger).Log("msg", "Writing batch failed", "writes", len(batch), "err", err)
+	}
+
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+	for i, op := range batch {
+		if errs[i] == nil {
+			errs[i] = err
+		}
+		op.done <- errs[i]
+		if q.pending[op.actor]--; q.pending[op.actor] <= 0 {
+			delete(q.pending, op.actor)
+		}
+	}
+}
+
+// checkpoint returns a function restoring the rule groups and annotations to
+// their current state.
+func (manager *RulesManager) checkpoint() func() {
+	groups := make([]RuleGroup, len(manager.ruleGroups.Groups))
+	for i, g := range manager.ruleGroups.Groups {
+		g.Rules = append([]RuleNode(nil), g.Rules...)
+		groups[i] = g
+	}
+	annotations := make(map[string]string, len(manager.annotations))
+	for k, v := range manager.annotations {
+		annotations[k] = v
+	}
+	return func() {
+		manager.ruleGroups.Groups = groups
+		manager.annotations = annotations
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/go-kit/log"
+)
+
+func TestWriteQueueCollect(t *testing.T) {
+	op := func(description string, exclusive bool) *queuedOp {
+		return &queuedOp{writeOp: writeOp{description: description, exclusive: exclusive}}
+	}
+	var (
+		many     []*queuedOp
+		manyWant []string
+	)
+	for i := 0; i < maxBatchSize+10; i++ {
+		many = append(many, op("op", false))
+	}
+	for i := 0; i < maxBatchSize; i++ {
+		manyWant = append(manyWant, "op")
+	}
+
+	for _, tc := range []struct {
+		name   string
+		batch  []*queuedOp
+		queued []*queuedOp
+		want   []string
+		held   string
+		left   int
+	}{
+		{
+			name:   "writes are batched",
+			batch:  []*queuedOp{op("a", false)},
+			queued: []*queuedOp{op("b", false), op("c", false)},
+			want:   []string{"a", "b", "c"},
+		},
+		{
+			name:   "exclusive write ends the batch",
+			batch:  []*queuedOp{op("a", false)},
+			queued: []*queuedOp{op("b", false), op("sync", true), op("c", false)},
+			want:   []string{"a", "b"},
+			held:   "sync",
+			left:   1,
+		},
+		{
+			name:   "exclusive write is batched alone",
+			batch:  []*queuedOp{op("sync", true)},
+			queued: []*queuedOp{op("a", false)},
+			want:   []string{"sync"},
+			left:   1,
+		},
+		{
+			name:   "exclusive write starts an empty batch",
+			queued: []*queuedOp{op("sync", true), op("a", false)},
+			want:   []string{"sync"},
+			left:   1,
+		},
+		{
+			name:   "batches are limited",
+			queued: many,
+			want:   manyWant,
+			left:   10,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			q := &WriteQueue{ops: make(chan *queuedOp, len(tc.queued))}
+			for _, op := range tc.queued {
+				q.ops <- op
+			}
+			batch := q.collect(tc.batch, 0)
+
+			var got []string
+			for _, op := range batch {
+				got = append(got, op.description)
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("batch = %v, want %v", got, tc.want)
+			}
+			held := ""
+			if q.held != nil {
+				held = q.held.description
+			}
+			if held != tc.held {
+				t.Errorf("held = %q, want %q", held, tc.held)
+			}
+			if len(q.ops) != tc.left {
+				t.Errorf("%d writes left in the queue, want %d", len(q.ops), tc.left)
+			}
+		})
+	}
+}
+
+func TestApplyErrorsPerOp(t *testing.T) {
+	defer func(policy string) { *conflictPolicy = policy }(*conflictPolicy)
+	*conflictPolicy = conflictReject
+
+	errFailed := errors.New("failed")
+	record := func(group, name, expr string) writeOp {
+		return addRulesOp(SimpleRuleGroup{Name: group, Rules: []Rule{{Record: name, Expr: expr}}})
+	}
+	failing := writeOp{
+		description: "failing",
+		mutate: func(manager *RulesManager) error {
+			manager.ruleGroups.Groups = nil
+			manager.annotations["changed"] = "true"
+			return errFailed
+		},
+	}
+
+	manager := newTestManager(SimpleRuleGroup{Name: "a", Rules: []Rule{{Record: "a:up", Expr: "up"}}})
+	ops := []writeOp{
+		record("a", "a:down", "1 - up"),
+		failing,
+		// Writes the same series as a:up in another group.
+		record("b", "a:up", "max(up)"),
+		record("b", "b:up", "min(up)"),
+	}
+	wantErrs := []error{nil, errFailed, errRuleConflict, nil}
+
+	conflicts := findConflicts(snapshot(manager.ruleGroups))
+	for i, op := range ops {
+		var err error
+		conflicts, _, err = manager.apply(log.NewNopLogger(), op, conflicts)
+		if !errors.Is(err, wantErrs[i]) {
+			t.Errorf("write %d: err = %v, want %v", i, err, wantErrs[i])
+		}
+	}
+
+	want := []SimpleRuleGroup{
+		{Name: "a", Rules: []Rule{{Record: "a:up", Expr: "up"}, {Record: "a:down", Expr: "1 - up"}}},
+		{Name: "b", Rules: []Rule{{Record: "b:up", Expr: "min(up)"}}},
+	}
+	if got := snapshot(manager.ruleGroups); !reflect.DeepEqual(got, want) {
+		t.Errorf("groups = %+v, want %+v", got, want)
+	}
+	if _, ok := manager.annotations["changed"]; ok {
+		t.Error("annotations of the failed write were kept")
+	}
+}